@@ -1,3 +1,4 @@
 #!/usr/bin/env bash
 
-env GOOS=linux go build -v -ldflags="-s -w" share.go
+go mod download
+env GOOS=linux go build -v -ldflags="-s -w" -o share .
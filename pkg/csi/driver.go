@@ -0,0 +1,195 @@
+package csi
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kuberlab/s3share/pkg/share"
+	_ "github.com/kuberlab/s3share/pkg/share/backends"
+	"github.com/kuberlab/s3share/pkg/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DriverName    = "share.kuberlab.io"
+	DriverVersion = "1.0.0"
+)
+
+// Driver serves CSI identity and node services on top of share backends.
+// Volume context is passed to share.NewShare the same way FlexVolume options are.
+type Driver struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedNodeServer
+
+	slog   util.Logger
+	exec   util.Interface
+	node   share.NodeConfig
+	nodeID string
+	server *grpc.Server
+}
+
+func NewDriver(slog util.Logger, exec util.Interface, node share.NodeConfig, nodeID string) *Driver {
+	return &Driver{slog: slog, exec: exec, node: node, nodeID: nodeID}
+}
+
+// Run listens on endpoint (unix:///path/csi.sock or tcp://host:port) and serves requests.
+func (d *Driver) Run(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Failed parse endpoint '%s': %v", endpoint, err)
+	}
+	var addr string
+	switch u.Scheme {
+	case "unix":
+		addr = u.Path
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed remove socket '%s': %v", addr, err)
+		}
+	case "tcp":
+		addr = u.Host
+	default:
+		return fmt.Errorf("Endpoint scheme '%s' is not supported", u.Scheme)
+	}
+	l, err := net.Listen(u.Scheme, addr)
+	if err != nil {
+		return fmt.Errorf("Failed listen '%s': %v", endpoint, err)
+	}
+	return d.Serve(l)
+}
+
+// Serve serves requests on l until Stop is called.
+func (d *Driver) Serve(l net.Listener) error {
+	d.server = grpc.NewServer(grpc.UnaryInterceptor(d.logRequest))
+	csi.RegisterIdentityServer(d.server, d)
+	csi.RegisterNodeServer(d.server, d)
+	d.slog.Info(fmt.Sprintf("CSI driver '%s' is listening on %v", DriverName, l.Addr()))
+	return d.server.Serve(l)
+}
+
+func (d *Driver) Stop() {
+	if d.server != nil {
+		d.server.GracefulStop()
+	}
+}
+
+// logRequest logs failures and redacts secrets of the request from the error.
+// The secrets are registered only while the request is served.
+func (d *Driver) logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if r, ok := req.(interface{ GetSecrets() map[string]string }); ok {
+		var values []string
+		for _, v := range r.GetSecrets() {
+			values = append(values, v)
+		}
+		defer util.AddSecrets(values...)()
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		d.slog.Err(fmt.Sprintf("Method '%s' failed: %v", info.FullMethod, err))
+		if st, ok := status.FromError(err); ok {
+			err = status.Error(st.Code(), util.Redact(st.Message()))
+		}
+	}
+	return resp, err
+}
+
+func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          DriverName,
+		VendorVersion: DriverVersion,
+	}, nil
+}
+
+func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	// Node only plugin.
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: d.nodeID}, nil
+}
+
+func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	// Shares are mounted directly to the target path, no staging is required.
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability is required")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Block volumes are not supported")
+	}
+	d.slog.Info(fmt.Sprintf("Publish volume '%s' to '%s'", req.GetVolumeId(), target))
+
+	c := ShareConf(req)
+	s, err := share.NewShareWithExec(d.slog, d.exec, d.node, c)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Stat of a stale FUSE mount fails, so it is detached first.
+	if _, err := util.DetachStaleMount(d.slog, target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed create target path: %v", err)
+	}
+	if err := share.MountShare(d.slog, d.exec, d.node, s, c, target); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required")
+	}
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path is required")
+	}
+	d.slog.Info(fmt.Sprintf("Unpublish volume '%s' from '%s'", req.GetVolumeId(), target))
+
+	if err := share.UnMount(d.slog, d.exec, d.node, target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed unmount '%s': %v", target, err)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "Failed remove target path: %v", err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// ShareConf converts publish request to the options format kubelet passes to FlexVolume drivers.
+func ShareConf(req *csi.NodePublishVolumeRequest) map[string]interface{} {
+	c := make(map[string]interface{})
+	for k, v := range req.GetVolumeContext() {
+		c[k] = v
+	}
+	for k, v := range req.GetSecrets() {
+		c["kubernetes.io/secret/"+k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	if req.GetReadonly() {
+		c["kubernetes.io/readwrite"] = "ro"
+	} else {
+		c["kubernetes.io/readwrite"] = "rw"
+	}
+	return c
+}
@@ -0,0 +1,183 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testConfig struct {
+	share.Access
+	Source string `share:"source,required"`
+	Token  string `share:"token,secret"`
+}
+
+// testShare mounts with mount command, its output is returned on failure
+// the way real backends do.
+type testShare struct {
+	exec util.Interface
+	conf *testConfig
+}
+
+func (s *testShare) Mount(path string) error {
+	out, err := util.ExecCommand(s.exec, "mount", []string{"-t", "csitest", "-o", string(s.conf.Mode), s.conf.Source, path}, "")
+	if err != nil {
+		return fmt.Errorf("Failed mount out='%s' error='%v'", out, err)
+	}
+	return nil
+}
+
+func (s *testShare) UnMount(path string) error {
+	out, err := util.ExecCommand(s.exec, "umount", []string{path}, "")
+	if err != nil {
+		return fmt.Errorf("Failed unmount out='%s' error='%v'", out, err)
+	}
+	return nil
+}
+
+func init() {
+	share.Register("csitest", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &testConfig{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		return &testShare{exec: exec, conf: conf}, nil
+	}, &testConfig{})
+}
+
+func startDriver(t *testing.T, exec util.Interface) csi.NodeClient {
+	share.RecordStateDir = t.TempDir()
+	d := NewDriver(util.FakeLogger{T: t}, exec, share.NodeConfig{}, "node1")
+	l := bufconn.Listen(1 << 20)
+	go d.Serve(l)
+	t.Cleanup(d.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return csi.NewNodeClient(conn)
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+}
+
+func TestPublishInvalidArgument(t *testing.T) {
+	client := startDriver(t, &util.FakeExec{})
+	target := filepath.Join(t.TempDir(), "target")
+	ctx := map[string]string{"kuberlabFS": "csitest", "source": "src"}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+	}
+	cases := []struct {
+		name string
+		req  *csi.NodePublishVolumeRequest
+	}{
+		{"no volume ID", &csi.NodePublishVolumeRequest{TargetPath: target, VolumeCapability: mountCapability(), VolumeContext: ctx}},
+		{"no target path", &csi.NodePublishVolumeRequest{VolumeId: "vol1", VolumeCapability: mountCapability(), VolumeContext: ctx}},
+		{"no capability", &csi.NodePublishVolumeRequest{VolumeId: "vol1", TargetPath: target, VolumeContext: ctx}},
+		{"block capability", &csi.NodePublishVolumeRequest{VolumeId: "vol1", TargetPath: target, VolumeCapability: block, VolumeContext: ctx}},
+		{"missing option", &csi.NodePublishVolumeRequest{VolumeId: "vol1", TargetPath: target, VolumeCapability: mountCapability(),
+			VolumeContext: map[string]string{"kuberlabFS": "csitest"}}},
+	}
+	for _, c := range cases {
+		_, err := client.NodePublishVolume(context.Background(), c.req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", c.name, err)
+		}
+	}
+
+	_, err := client.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{TargetPath: target})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unpublish without volume ID: got %v, want InvalidArgument", err)
+	}
+	_, err = client.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol1"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unpublish without target path: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestPublishUnpublish(t *testing.T) {
+	log := &util.FakeCommandLog{}
+	exec := &util.FakeExec{CommandScript: []util.FakeCommandAction{
+		log.Action("", nil),
+		log.Action("", nil),
+	}}
+	client := startDriver(t, exec)
+	target := filepath.Join(t.TempDir(), "target")
+
+	_, err := client.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol1",
+		TargetPath:       target,
+		VolumeCapability: mountCapability(),
+		Readonly:         true,
+		VolumeContext:    map[string]string{"kuberlabFS": "csitest", "source": "src"},
+		Secrets:          map[string]string{"token": "s3cr3t"},
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	_, err = client.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	})
+	if err != nil {
+		t.Fatalf("unpublish: %v", err)
+	}
+
+	want := [][]string{
+		{"mount", "-t", "csitest", "-o", "ro", "src", target},
+		{"umount", target},
+	}
+	if !reflect.DeepEqual(log.Cmds, want) {
+		t.Errorf("got commands %v, want %v", log.Cmds, want)
+	}
+}
+
+func TestPublishErrorRedacted(t *testing.T) {
+	const secret = "s3cr3t"
+	log := &util.FakeCommandLog{}
+	exec := &util.FakeExec{CommandScript: []util.FakeCommandAction{
+		log.Action("bad token "+secret, util.FakeExitError{Status: 1}),
+	}}
+	client := startDriver(t, exec)
+
+	_, err := client.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol1",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: mountCapability(),
+		VolumeContext:    map[string]string{"kuberlabFS": "csitest", "source": "src"},
+		Secrets:          map[string]string{"token": secret + "\n"},
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	if msg := status.Convert(err).Message(); strings.Contains(msg, secret) || !strings.Contains(msg, "bad token ******") {
+		t.Errorf("secret is not redacted in '%s'", msg)
+	}
+	// Secrets are registered only while the request is served.
+	if util.Redact(secret) != secret {
+		t.Errorf("secret is still registered after the request")
+	}
+}
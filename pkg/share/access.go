@@ -0,0 +1,71 @@
+package share
+
+import (
+	"fmt"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// AccessMode is access mode requested by kubelet in kubernetes.io/readwrite option.
+type AccessMode string
+
+const (
+	ReadOnly  AccessMode = "ro"
+	ReadWrite AccessMode = "rw"
+
+	accessModeOption = "kubernetes.io/readwrite"
+)
+
+// Access is embedded into backend configs to get requested access mode.
+type Access struct {
+	Mode AccessMode `share:"kubernetes.io/readwrite" default:"rw" description:"Access mode requested by kubelet"`
+}
+
+func (a Access) ReadOnly() bool {
+	return a.Mode == ReadOnly
+}
+
+// RequestedAccessMode returns access mode requested in share options.
+// Read-write is assumed if kubelet didn't pass the mode.
+func RequestedAccessMode(c map[string]interface{}) (AccessMode, error) {
+	raw, ok := c[accessModeOption]
+	if !ok {
+		return ReadWrite, nil
+	}
+	switch raw {
+	case string(ReadOnly):
+		return ReadOnly, nil
+	case string(ReadWrite), "":
+		return ReadWrite, nil
+	default:
+		return "", fmt.Errorf("Bad access mode '%v' in '%s'", raw, accessModeOption)
+	}
+}
+
+func checkAccessMode(name string, supported []AccessMode, mode AccessMode) error {
+	if len(supported) == 0 {
+		return nil
+	}
+	for _, m := range supported {
+		if m == mode {
+			return nil
+		}
+	}
+	if mode == ReadWrite {
+		return fmt.Errorf("FS type '%s' supports only read-only access, set readOnly for the volume", name)
+	}
+	return fmt.Errorf("FS type '%s' doesn't support read-only access", name)
+}
+
+// RemountReadOnly makes existing mount at path read-only.
+// It is used by backends which can't mount read-only by themselves.
+func RemountReadOnly(exec util.Interface, path string) error {
+	if mnt, err := util.FindMount(path); err == nil && mnt != nil && mnt.ReadOnly() {
+		return nil
+	}
+	out, err := util.ExecCommand(exec, "mount", []string{"-o", "remount,bind,ro", path}, "")
+	if err != nil {
+		return fmt.Errorf("Failed remount '%s' read-only out='%v' error='%v'", path, string(out), err)
+	}
+	return nil
+}
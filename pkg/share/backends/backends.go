@@ -0,0 +1,11 @@
+// Package backends registers all in-tree share backends.
+// Import it for side effects to make them available through share.NewShare.
+package backends
+
+import (
+	_ "github.com/kuberlab/s3share/pkg/share/download"
+	_ "github.com/kuberlab/s3share/pkg/share/git"
+	_ "github.com/kuberlab/s3share/pkg/share/plukefs"
+	_ "github.com/kuberlab/s3share/pkg/share/s3share"
+	_ "github.com/kuberlab/s3share/pkg/share/webdav"
+)
@@ -0,0 +1,262 @@
+package share
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// ConfigError lists all problems found in share options.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "Invalid share options: " + strings.Join(e, "; ")
+}
+
+// Validator is implemented by backend configs which need checks
+// beyond required fields, e.g. options which depend on each other.
+type Validator interface {
+	Validate() error
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeConfig fills struct pointed by out from share options.
+//
+// Fields are bound to options with `share:"name[,required][,secret][,node]"`
+// tag, fields of embedded structs (e.g. Access) are bound the same way.
+// Secret options are read from kubernetes.io/secret/<name>. Node options
+// come only from node config, see checkNodeOptions. Missing or empty
+// options get value from `default` tag. Supported field kinds are string,
+// bool, integers, time.Duration and []string given as comma separated list.
+// All problems are reported at once as ConfigError, Validate is run
+// even if some fields failed to decode so its checks are reported too.
+func DecodeConfig(c map[string]interface{}, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("share: DecodeConfig needs pointer to struct, got %T", out)
+	}
+	var errs ConfigError
+	decodeStruct(c, v.Elem(), &errs)
+	if val, ok := out.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			if ce, ok := err.(ConfigError); ok {
+				errs = append(errs, ce...)
+			} else {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// decodeStruct fills fields of v, embedded structs are decoded in place.
+func decodeStruct(c map[string]interface{}, v reflect.Value, errs *ConfigError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			decodeStruct(c, v.Field(i), errs)
+			continue
+		}
+		o, ok := fieldOption(f)
+		if !ok {
+			continue
+		}
+		raw, err := optionValue(c, o)
+		if err != nil {
+			*errs = append(*errs, err.Error())
+			continue
+		}
+		if raw == "" {
+			raw = o.Default
+		}
+		if raw == "" {
+			if o.Required {
+				*errs = append(*errs, fmt.Sprintf("'%s' is required", o.Name))
+			}
+			continue
+		}
+		if err := setField(v.Field(i), raw); err != nil {
+			*errs = append(*errs, fmt.Sprintf("'%s': %v", o.Name, err))
+		}
+	}
+}
+
+// checkValues reports values which are not options of config type t
+// or can't be decoded into them. Secret options can't be given this way.
+func checkValues(t reflect.Type, values map[string]interface{}) ConfigError {
+	var errs ConfigError
+	known := make(map[string]bool)
+	checkStruct(reflect.New(t).Elem(), values, known, &errs)
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, fmt.Sprintf("unknown option '%s'", name))
+	}
+	return errs
+}
+
+func checkStruct(v reflect.Value, values map[string]interface{}, known map[string]bool, errs *ConfigError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			checkStruct(v.Field(i), values, known, errs)
+			continue
+		}
+		o, ok := fieldOption(f)
+		if !ok {
+			continue
+		}
+		if _, ok := values[o.Name]; !ok {
+			continue
+		}
+		known[o.Name] = true
+		if o.Secret {
+			*errs = append(*errs, fmt.Sprintf("'%s' is secret and can't be set here", o.Name))
+			continue
+		}
+		raw, err := optionValue(values, o)
+		if err != nil {
+			*errs = append(*errs, err.Error())
+			continue
+		}
+		if raw == "" {
+			continue
+		}
+		if err := setField(v.Field(i), raw); err != nil {
+			*errs = append(*errs, fmt.Sprintf("'%s': %v", o.Name, err))
+		}
+	}
+}
+
+// checkNodeOptions reports node options set in share options c of a volume.
+func checkNodeOptions(options []Option, c map[string]interface{}) ConfigError {
+	var errs ConfigError
+	for _, o := range options {
+		if _, ok := c[o.Name]; ok && o.Node {
+			errs = append(errs, fmt.Sprintf("'%s' can be set only in node config", o.Name))
+		}
+	}
+	return errs
+}
+
+// ConfigOptions describes options of the config struct for Register.
+func ConfigOptions(config interface{}) []Option {
+	t := reflect.TypeOf(config)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var options []Option
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			options = append(options, ConfigOptions(reflect.New(f.Type).Interface())...)
+			continue
+		}
+		if o, ok := fieldOption(f); ok {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+func fieldOption(f reflect.StructField) (Option, bool) {
+	tag := f.Tag.Get("share")
+	if tag == "" || tag == "-" {
+		return Option{}, false
+	}
+	parts := strings.Split(tag, ",")
+	o := Option{
+		Name:        parts[0],
+		Description: f.Tag.Get("description"),
+		Default:     f.Tag.Get("default"),
+	}
+	for _, p := range parts[1:] {
+		switch p {
+		case "required":
+			o.Required = true
+		case "secret":
+			o.Secret = true
+		case "node":
+			o.Node = true
+		}
+	}
+	return o, true
+}
+
+func optionValue(c map[string]interface{}, o Option) (string, error) {
+	if o.Secret {
+		if _, ok := c["kubernetes.io/secret/"+o.Name]; !ok {
+			return "", nil
+		}
+		return util.GetSecretString(c, o.Name)
+	}
+	raw, ok := c[o.Name]
+	if !ok || raw == nil {
+		return "", nil
+	}
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case bool, float64, int, int64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("'%s' must be a string, got %T", o.Name, raw)
+	}
+}
+
+func setField(f reflect.Value, raw string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("bad boolean '%s'", raw)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %v", f.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad integer '%s'", raw)
+		}
+		f.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported field type %v", f.Type())
+	}
+	return nil
+}
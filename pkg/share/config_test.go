@@ -0,0 +1,160 @@
+package share
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type configTestConfig struct {
+	Access
+	Name    string        `share:"name,required"`
+	Token   string        `share:"token,secret"`
+	Port    int           `share:"port" default:"8080"`
+	Debug   bool          `share:"debug"`
+	Timeout time.Duration `share:"timeout" default:"1m"`
+	Paths   []string      `share:"paths"`
+	Min     int           `share:"min"`
+	Max     int           `share:"max"`
+	Ignored string
+}
+
+func (c *configTestConfig) Validate() error {
+	if c.Min > c.Max {
+		return errors.New("'min' must not be greater than 'max'")
+	}
+	return nil
+}
+
+func TestDecodeConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		c    map[string]interface{}
+		want configTestConfig
+		errs ConfigError
+	}{
+		{
+			name: "defaults",
+			c:    map[string]interface{}{"name": "data"},
+			want: configTestConfig{Access: Access{Mode: ReadWrite}, Name: "data", Port: 8080, Timeout: time.Minute},
+		},
+		{
+			name: "values",
+			c: map[string]interface{}{
+				"name":                       "data",
+				"kubernetes.io/secret/token": "c2VjcmV0",
+				"kubernetes.io/readwrite":    "ro",
+				"port":                       "9000",
+				"debug":                      true,
+				"timeout":                    "30s",
+				"paths":                      "a, b,,c",
+				"max":                        float64(3),
+				"unknown":                    "ignored",
+			},
+			want: configTestConfig{
+				Access:  Access{Mode: ReadOnly},
+				Name:    "data",
+				Token:   "secret",
+				Port:    9000,
+				Debug:   true,
+				Timeout: 30 * time.Second,
+				Paths:   []string{"a", "b", "c"},
+				Max:     3,
+			},
+		},
+		{
+			name: "empty value takes default",
+			c:    map[string]interface{}{"name": "data", "port": ""},
+			want: configTestConfig{Access: Access{Mode: ReadWrite}, Name: "data", Port: 8080, Timeout: time.Minute},
+		},
+		{
+			name: "secret given as plain option is ignored",
+			c:    map[string]interface{}{"name": "data", "token": "plain"},
+			want: configTestConfig{Access: Access{Mode: ReadWrite}, Name: "data", Port: 8080, Timeout: time.Minute},
+		},
+		{
+			name: "all errors at once",
+			c: map[string]interface{}{
+				"port":    "http",
+				"debug":   "maybe",
+				"timeout": "soon",
+				"paths":   []interface{}{"a"},
+				"min":     "5",
+			},
+			errs: ConfigError{
+				"'name' is required",
+				"'port': bad integer 'http'",
+				"'debug': bad boolean 'maybe'",
+				"'timeout': time: invalid duration \"soon\"",
+				"'paths' must be a string, got []interface {}",
+				"'min' must not be greater than 'max'",
+			},
+		},
+		{
+			name: "bad secret encoding",
+			c:    map[string]interface{}{"name": "data", "kubernetes.io/secret/token": "%%%"},
+			errs: ConfigError{"Failed decode secret 'token'"},
+		},
+	}
+	for _, c := range cases {
+		got := configTestConfig{}
+		err := DecodeConfig(c.c, &got)
+		if c.errs != nil {
+			if !reflect.DeepEqual(err, c.errs) {
+				t.Errorf("%s: got error %#v, want %#v", c.name, err, c.errs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDecodeConfigNotStruct(t *testing.T) {
+	var s string
+	if err := DecodeConfig(nil, &s); err == nil {
+		t.Error("decoding into string succeeded")
+	}
+}
+
+func TestCheckValues(t *testing.T) {
+	cases := []struct {
+		name   string
+		values map[string]interface{}
+		errs   ConfigError
+	}{
+		{"valid", map[string]interface{}{"port": 9000, "timeout": "5m", "debug": false}, nil},
+		{"required is not checked", map[string]interface{}{}, nil},
+		{
+			"secret",
+			map[string]interface{}{"token": "plain"},
+			ConfigError{"'token' is secret and can't be set here"},
+		},
+		{
+			"type mismatch",
+			map[string]interface{}{"port": "http", "timeout": 5, "paths": map[string]interface{}{}},
+			ConfigError{
+				"'port': bad integer 'http'",
+				"'timeout': time: missing unit in duration \"5\"",
+				"'paths' must be a string, got map[string]interface {}",
+			},
+		},
+		{
+			"unknown",
+			map[string]interface{}{"name": "data", "zone": "a", "bucket": "b"},
+			ConfigError{"unknown option 'bucket'", "unknown option 'zone'"},
+		},
+	}
+	for _, c := range cases {
+		errs := checkValues(reflect.TypeOf(configTestConfig{}), c.values)
+		if !reflect.DeepEqual(errs, c.errs) {
+			t.Errorf("%s: got %#v, want %#v", c.name, errs, c.errs)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package share
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// Daemon is embedded into configs of backends serving mounts from
+// containers, it selects container runtime running them.
+type Daemon struct {
+	Runtime string `share:"runtime,node" default:"docker" description:"Container runtime of mount daemons: docker, containerd or podman"`
+}
+
+// Validate is called from Validate of the embedding config.
+func (d Daemon) Validate() error {
+	_, err := util.NewDaemonRuntime(d.Runtime, nil)
+	return err
+}
+
+func (d Daemon) NewRuntime(exec util.Interface) (util.DaemonRuntime, error) {
+	return util.NewDaemonRuntime(d.Runtime, exec)
+}
+
+// nodeRuntime returns runtime set in all section of node config, it serves
+// mounts whose share is unknown. Docker is used if it is not valid.
+func nodeRuntime(slog util.Logger, exec util.Interface, node NodeConfig) util.DaemonRuntime {
+	d := &Daemon{}
+	if err := DecodeConfig(node[AllFS], d); err != nil {
+		slog.Warning(fmt.Sprintf("Using %s runtime: %v", util.RuntimeDocker, err))
+		return util.NewDockerClient(util.DockerSocket)
+	}
+	rt, _ := d.NewRuntime(exec)
+	return rt
+}
+
+var daemonType = reflect.TypeOf(Daemon{})
+
+// usesDaemon tells whether config of backend fs embeds Daemon.
+func usesDaemon(fs string) bool {
+	backendsMu.RLock()
+	b, ok := backends[fs]
+	backendsMu.RUnlock()
+	return ok && embedsDaemon(b.config)
+}
+
+func embedsDaemon(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && (f.Type == daemonType || embedsDaemon(f.Type)) {
+			return true
+		}
+	}
+	return false
+}
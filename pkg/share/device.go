@@ -0,0 +1,134 @@
+package share
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+const (
+	StateDir       = "/var/lib/kuberlab-share"
+	DeviceStateDir = StateDir + "/devices"
+)
+
+// LockStateDir is a variable so tests can keep locks in a temp dir.
+var LockStateDir = StateDir + "/locks"
+
+// LockPath returns path of node-wide lock with given name, see util.Lock.
+func LockPath(name string) string {
+	return filepath.Join(LockStateDir, name+".lock")
+}
+
+// VolumeName returns stable name of the volume described by share options.
+// Kubelet specific options (pod info, secrets, fsType) don't affect the name.
+func VolumeName(c map[string]interface{}) (string, error) {
+	fs, ok := c["kuberlabFS"].(string)
+	if !ok || fs == "" {
+		return "", fmt.Errorf("FS type to share is not defined")
+	}
+	opts := map[string]interface{}{}
+	for k, v := range c {
+		if strings.HasPrefix(k, "kubernetes.io/") {
+			continue
+		}
+		opts[k] = v
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("Failed encode share options: %v", err)
+	}
+	return fmt.Sprintf("%s-%x", fs, sha1.Sum(data)), nil
+}
+
+// SaveDevice records global mount path of the virtual device.
+func SaveDevice(device string, path string) error {
+	if err := os.MkdirAll(DeviceStateDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(DeviceStateDir, device), []byte(path), 0600)
+}
+
+// RemoveDevice drops records of all devices mounted to path.
+func RemoveDevice(path string) error {
+	files, err := ioutil.ReadDir(DeviceStateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		p := filepath.Join(DeviceStateDir, f.Name())
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		if string(data) == path {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MountedDevice returns global mount path of the device if it is still mounted.
+func MountedDevice(device string) (string, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(DeviceStateDir, device))
+	if err != nil {
+		return "", false
+	}
+	path := string(data)
+	if mounted, err := util.IsMounted(path); err != nil || !mounted {
+		return "", false
+	}
+	if stale, _ := util.IsStaleMount(path); stale {
+		return "", false
+	}
+	return path, true
+}
+
+// BindMount exposes already mounted device to another path.
+type BindMount struct {
+	slog   util.Logger
+	exec   util.Interface
+	source string
+	mode   AccessMode
+}
+
+func NewBindMount(slog util.Logger, source string, mode AccessMode) *BindMount {
+	return &BindMount{slog: slog, source: source, mode: mode, exec: util.NewExec()}
+}
+
+func (m *BindMount) Mount(path string) error {
+	if isMounted, err := util.IsMounted(path); err != nil {
+		return fmt.Errorf("Failed test mount %v", err)
+	} else if isMounted {
+		return nil
+	}
+	out, err := util.ExecCommand(m.exec, "mount", []string{"--bind", m.source, path}, "")
+	if err != nil {
+		return fmt.Errorf("Failed bind mount '%v' out='%v' error='%v'", m.source, string(out), err)
+	}
+	m.slog.Info(fmt.Sprintf("Bind mount '%s' to '%s'", m.source, path))
+	if m.mode == ReadOnly {
+		return RemountReadOnly(m.exec, path)
+	}
+	return nil
+}
+
+func (m *BindMount) UnMount(path string) error {
+	if isMounted, err := util.IsMounted(path); err != nil {
+		return fmt.Errorf("Failed test mount %v", err)
+	} else if !isMounted {
+		return nil
+	}
+	return syscall.Unmount(path, 0)
+}
@@ -0,0 +1,160 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Download states reported by the downloader.
+const (
+	statePending     = "pending"
+	stateDownloading = "downloading"
+	stateDone        = "done"
+	stateFailed      = "failed"
+)
+
+const requestTimeout = 30 * time.Second
+
+// pollInterval is a variable so tests don't wait for status long.
+var pollInterval = 2 * time.Second
+
+// downloadStatus is returned by the downloader for
+//
+//	POST {downloader_url}/{object_workspace}/{dataset}/{version}
+//	GET  {downloader_url}/{object_workspace}/{dataset}/{version}/status
+//
+// POST starts the download or joins already running one, so a mount
+// retried by kubelet picks up where the previous call stopped. Downloaders
+// before this API only serve GET of the dataset URL, which blocks until
+// the download is done and returns the dataset directory as plain text.
+type downloadStatus struct {
+	Status string `json:"status"`
+	// Progress is percent of downloaded data.
+	Progress float64 `json:"progress"`
+	// Path is dataset directory on the node when download is done.
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type downloader struct {
+	url       string
+	workspace string
+	secret    string
+	client    *http.Client
+}
+
+func (d *downloader) do(method string, url string, timeout time.Duration) (int, []byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	// -H "X-Workspace-Name: <secret_workspace>" -H "X-Workspace-Secret: $secret"
+	req.Header.Set("X-Workspace-Name", d.workspace)
+	req.Header.Set("X-Workspace-Secret", d.secret)
+	client := *d.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, data, err
+}
+
+func (d *downloader) status(method string, url string) (*downloadStatus, int, error) {
+	code, data, err := d.do(method, url, requestTimeout)
+	if err != nil {
+		return nil, code, err
+	}
+	if code >= 400 {
+		return nil, code, fmt.Errorf("Downloader returned %v: %v", code, strings.TrimSpace(string(data)))
+	}
+	st := &downloadStatus{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, code, fmt.Errorf("Bad downloader status: %v", err)
+	}
+	return st, code, nil
+}
+
+// legacyDownloader tells whether code answered to POST means the downloader
+// predates asynchronous API. Other errors, e.g. bad credentials, are real.
+func legacyDownloader(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented
+}
+
+// download waits until dataset is downloaded and returns its directory.
+// If the downloader doesn't know POST, it is taken for an older one and
+// asked with single blocking GET.
+func (m *Mount) download(d *downloader, timeout time.Duration) (string, error) {
+	name := fmt.Sprintf("%s:%s", m.conf.Dataset, m.conf.Version)
+	st, code, err := d.status("POST", d.url)
+	if err != nil && !legacyDownloader(code) {
+		return "", fmt.Errorf("Download of %s failed: %v", name, err)
+	}
+	if err != nil {
+		m.slog.Info(fmt.Sprintf("Downloader doesn't support asynchronous download (%v), waiting for it", err))
+		code, data, err := d.do("GET", d.url, timeout)
+		if err != nil {
+			return "", fmt.Errorf("Download of %s failed: %v", name, err)
+		}
+		if code >= 400 {
+			return "", fmt.Errorf("Download of %s failed: %v: %v", name, code, strings.TrimSpace(string(data)))
+		}
+		return string(data), nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		switch st.Status {
+		case stateDone:
+			m.slog.Info(fmt.Sprintf("Downloaded %s to %s", name, st.Path))
+			return st.Path, nil
+		case stateFailed:
+			return "", fmt.Errorf("Download of %s failed: %s", name, st.Error)
+		case statePending, stateDownloading:
+			m.slog.Info(fmt.Sprintf("Downloading %s: %.1f%%", name, st.Progress))
+		default:
+			return "", fmt.Errorf("Unknown download status '%s' of %s", st.Status, name)
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return "", fmt.Errorf(
+				"Dataset %s is still downloading (%.1f%%) after %v, mount will be retried",
+				name, st.Progress, timeout,
+			)
+		}
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+		time.Sleep(wait)
+		if st, _, err = d.status("GET", d.url+"/status"); err != nil {
+			return "", err
+		}
+	}
+}
+
+// checkDatasetDir makes sure path reported by the downloader is
+// an existing directory inside download_dir.
+func (m *Mount) checkDatasetDir(path string) (string, error) {
+	path = filepath.Clean(strings.TrimSpace(path))
+	root := filepath.Clean(m.conf.DownloadDir)
+	if !filepath.IsAbs(path) || !strings.HasPrefix(path, root+"/") {
+		return "", fmt.Errorf("Downloader returned path '%s' outside of '%s'", path, root)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("Downloaded dataset is not available: %v", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("Downloaded dataset '%s' is not a directory", path)
+	}
+	return path, nil
+}
@@ -0,0 +1,170 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// fakeDownloader answers requests with handler and records them.
+type fakeDownloader struct {
+	mu       sync.Mutex
+	requests []string
+	server   *httptest.Server
+}
+
+func newFakeDownloader(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *fakeDownloader {
+	f := &fakeDownloader{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Workspace-Name") != "ws" || r.Header.Get("X-Workspace-Secret") != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+		f.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeDownloader) download(t *testing.T, timeout time.Duration) (string, error) {
+	m := &Mount{slog: util.FakeLogger{T: t}, conf: &Config{Dataset: "ds", Version: "1.0.0"}}
+	d := &downloader{
+		url:       f.server.URL + "/v1/download/ws/ds/1.0.0",
+		workspace: "ws",
+		secret:    "secret",
+		client:    http.DefaultClient,
+	}
+	return m.download(d, timeout)
+}
+
+func (f *fakeDownloader) calls() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.requests, ", ")
+}
+
+func setPollInterval(t *testing.T, d time.Duration) {
+	old := pollInterval
+	pollInterval = d
+	t.Cleanup(func() {
+		pollInterval = old
+	})
+}
+
+func TestDownloadPoll(t *testing.T) {
+	setPollInterval(t, time.Millisecond)
+	polls := 0
+	f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			w.Write([]byte(`{"status":"pending"}`))
+		case polls < 2:
+			polls++
+			w.Write([]byte(`{"status":"downloading","progress":50}`))
+		default:
+			w.Write([]byte(`{"status":"done","progress":100,"path":"/pluk-tmp/ws/ds/1.0.0"}`))
+		}
+	})
+	dir, err := f.download(t, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "/pluk-tmp/ws/ds/1.0.0" {
+		t.Errorf("got dir '%s'", dir)
+	}
+	want := "POST /v1/download/ws/ds/1.0.0, " + strings.Repeat("GET /v1/download/ws/ds/1.0.0/status, ", 3)
+	if got := f.calls(); got != strings.TrimSuffix(want, ", ") {
+		t.Errorf("got requests %s", got)
+	}
+}
+
+func TestDownloadFailed(t *testing.T) {
+	f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"failed","error":"no such version"}`))
+	})
+	_, err := f.download(t, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "no such version") {
+		t.Errorf("got %v, want download error", err)
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	setPollInterval(t, time.Millisecond)
+	f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"downloading","progress":10}`))
+	})
+	_, err := f.download(t, 20*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "still downloading (10.0%)") {
+		t.Errorf("got %v, want timeout", err)
+	}
+}
+
+// Older downloaders serve only blocking GET and don't know POST.
+func TestDownloadFallback(t *testing.T) {
+	for _, post := range []int{http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				w.WriteHeader(post)
+				w.Write([]byte("not a status"))
+				return
+			}
+			w.Write([]byte("/pluk-tmp/ws/ds/1.0.0"))
+		})
+		dir, err := f.download(t, time.Minute)
+		if err != nil {
+			t.Errorf("POST %d: %v", post, err)
+			continue
+		}
+		if dir != "/pluk-tmp/ws/ds/1.0.0" {
+			t.Errorf("POST %d: got dir '%s'", post, dir)
+		}
+		if got := f.calls(); got != "POST /v1/download/ws/ds/1.0.0, GET /v1/download/ws/ds/1.0.0" {
+			t.Errorf("POST %d: got requests %s", post, got)
+		}
+	}
+}
+
+// Errors of downloaders knowing POST are reported, not retried with GET.
+func TestDownloadPostError(t *testing.T) {
+	cases := []struct {
+		code int
+		body string
+		want string
+	}{
+		{http.StatusUnauthorized, "bad secret", "401: bad secret"},
+		{http.StatusForbidden, "no access", "403: no access"},
+		{http.StatusBadRequest, "bad version", "400: bad version"},
+		{http.StatusInternalServerError, "disk full", "500: disk full"},
+		{http.StatusServiceUnavailable, "busy", "503: busy"},
+		{http.StatusOK, "not a status", "Bad downloader status"},
+	}
+	for _, c := range cases {
+		f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.code)
+			w.Write([]byte(c.body))
+		})
+		_, err := f.download(t, time.Minute)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("POST %d: got %v, want %s", c.code, err, c.want)
+		}
+		if got := f.calls(); got != "POST /v1/download/ws/ds/1.0.0" {
+			t.Errorf("POST %d: got requests %s", c.code, got)
+		}
+	}
+}
+
+func TestDownloadUnavailable(t *testing.T) {
+	f := newFakeDownloader(t, func(w http.ResponseWriter, r *http.Request) {})
+	f.server.Close()
+	if _, err := f.download(t, time.Minute); err == nil {
+		t.Error("download from stopped downloader succeeded")
+	}
+}
@@ -1,60 +1,142 @@
 package download
 
 import (
+	"context"
+	"crypto/sha1"
 	"fmt"
-	"io/ioutil"
-	"log/syslog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/kuberlab/s3share/pkg/share"
 	"github.com/kuberlab/s3share/pkg/util"
-	"os/exec"
 )
 
 type Mount struct {
-	slog *syslog.Writer
-	conf map[string]interface{}
+	slog util.Logger
+	conf *Config
 	exec util.Interface
+	rt   util.DaemonRuntime
 }
 
-func NewDownloadMount(slog *syslog.Writer, conf map[string]interface{}) *Mount {
+type Config struct {
+	share.Access
+	share.Daemon
+	ObjectWorkspace string `share:"object_workspace" description:"Workspace which owns the dataset"`
+	SecretWorkspace string `share:"secret_workspace" description:"Workspace used to authorize request, required with object_workspace"`
+	Workspace       string `share:"workspace" description:"Legacy alias for both object_workspace and secret_workspace"`
+	Dataset         string `share:"dataset,required" description:"Dataset name"`
+	Version         string `share:"version,required" description:"Dataset version"`
+	Token           string `share:"token,secret" description:"Workspace secret"`
+
+	// Downloader is shared by volumes on the node, so its settings are node options.
+	PlukURL         string `share:"pluk_url,node" default:"http://127.0.0.1:30802/pluk/v1" description:"Pluk API URL used by the downloader"`
+	DownloaderImage string `share:"downloader_image,node" default:"kuberlab/pluk-downloader:latest" description:"Downloader container image"`
+	DownloadDir     string `share:"download_dir,node" default:"/pluk-tmp" description:"Node directory datasets are downloaded to"`
+	DownloadRoot    string `share:"download_root,node" default:"/pluk-tmp" description:"Node directory download_dir has to be in"`
+	DownloaderURL   string `share:"downloader_url" default:"http://127.0.0.1:8084/v1/download" description:"Downloader API URL"`
+
+	DownloadTimeout time.Duration `share:"download_timeout" default:"90s" description:"How long mount waits for download, kubelet retries mount after it"`
+}
+
+func (c *Config) Validate() error {
+	var errs share.ConfigError
+	if c.ObjectWorkspace != "" {
+		if c.SecretWorkspace == "" {
+			errs = append(errs, "'secret_workspace' is required with 'object_workspace'")
+		}
+	} else if c.Workspace == "" {
+		errs = append(errs, "'workspace' or ('object_workspace' and 'secret_workspace') is required")
+	}
+	if err := c.Daemon.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if !inDir(c.DownloadDir, c.DownloadRoot) {
+		errs = append(errs, fmt.Sprintf("'download_dir' must be an absolute path in '%s'", c.DownloadRoot))
+	}
+	if c.DownloadTimeout <= 0 {
+		errs = append(errs, "'download_timeout' must be positive")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// inDir tells whether absolute path is dir or inside of it.
+func inDir(path, dir string) bool {
+	if !filepath.IsAbs(path) || !filepath.IsAbs(dir) {
+		return false
+	}
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func init() {
+	share.Register("download", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &Config{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		rt, err := conf.NewRuntime(exec)
+		if err != nil {
+			return nil, err
+		}
+		return NewDownloadMount(slog, exec, rt, conf), nil
+	}, &Config{}, share.ReadOnly)
+}
+
+func NewDownloadMount(slog util.Logger, exec util.Interface, rt util.DaemonRuntime, conf *Config) *Mount {
 	return &Mount{
 		slog: slog,
 		conf: conf,
-		exec: util.NewExec(),
+		exec: exec,
+		rt:   rt,
 	}
 }
 
+const (
+	// downloaderLock serializes starting of the downloader container on the node.
+	downloaderLock = "pluk-downloader"
+	downloaderName = "pluk-downloader"
+	// configLabel holds hash of settings the downloader was started with.
+	configLabel = "kuberlab.downloader.config"
+)
+
+// downloaderStartWait is a variable so tests don't wait for the downloader.
+var downloaderStartWait = 2 * time.Second
+
+func (c *Config) downloaderConfig() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(c.DownloaderImage+"\n"+c.PlukURL+"\n"+c.DownloadDir)))
+}
+
 func (m *Mount) EnsureDownloaderContainer() error {
-	var err error
-	var lockFile *os.File
-	for {
-		lockFile, err = os.OpenFile("/tmp/pluk.lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-		if os.IsExist(err) {
-			time.Sleep(time.Second * 2)
-		}
-		if os.IsNotExist(err) || err == nil {
-			break
-		}
+	lock, err := util.Lock(context.Background(), share.LockPath(downloaderLock), time.Minute*2)
+	if err != nil {
+		return err
 	}
-	defer os.Remove("/tmp/pluk.lock")
-	defer lockFile.Close()
+	defer lock.Unlock()
 
-	cmd := m.exec.Command(
-		"docker",
-		"inspect",
-		"pluk-downloader",
-	)
-	_, err = cmd.CombinedOutput()
-	if err == nil {
-		return nil
+	// Downloader is shared by all volumes on the node, it is restarted
+	// if it was started with other image, pluk URL or download directory.
+	want := m.conf.downloaderConfig()
+	st, err := m.rt.Inspect(downloaderName)
+	switch {
+	case err == nil:
+		if st.Labels[configLabel] == want {
+			return nil
+		}
+		m.slog.Info(fmt.Sprintf("Downloader configuration changed, restarting with image %s", m.conf.DownloaderImage))
+		if err := m.rt.Remove(downloaderName); err != nil {
+			return fmt.Errorf("Failed remove downloader: %v", err)
+		}
+	case err != util.ErrDaemonNotFound:
+		return fmt.Errorf("Failed inspect downloader: %v", err)
 	}
 
-	//os.Mkdir("/pluk-downloader", os.ModePerm)
-
 	// Start container and wait some secs
 	/*
 		docker run -d -e PLUK_URL=http://127.0.0.1:30802/pluk/v1 \
@@ -62,53 +144,31 @@ func (m *Mount) EnsureDownloaderContainer() error {
 		type=bind,source=/var/lib/kubelet/pods,target=/var/lib/kubelet/pods,readonly,bind-propagation=shared \
 		--name pluk-downloader --network=host --restart always kuberlab/pluk-downloader:latest
 	*/
-	cmd = m.exec.Command(
-		"docker",
-		"run",
-		"-d",
-		"-e",
-		"PLUK_URL=http://127.0.0.1:30802/pluk/v1",
-		//"PLUK_URL=https://dev.kuberlab.io/pluk/v1",
-		"-e",
-		"DEBUG=true",
-		"-e",
-		"DOWNLOAD_DIR=/pluk-tmp",
-		"-v",
-		"/pluk-tmp:/pluk-tmp",
-		"--mount",
-		"type=bind,source=/var/lib/kubelet/pods,target=/var/lib/kubelet/pods,readonly,bind-propagation=shared",
-		"--network=host",
-		"--name",
-		"pluk-downloader",
-		"--restart",
-		"always",
-		"kuberlab/pluk-downloader:latest",
-	)
-	_, err = cmd.CombinedOutput()
-	if err == nil {
-		time.Sleep(time.Second * 2)
-	}
-
-	return err
-}
-
-func (m *Mount) IsMounted(mountpoint string) (bool, error) {
-	_, err := os.Stat(mountpoint)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
-	}
-	out, err := util.ExecCommand(m.exec, "bash", []string{"-c", fmt.Sprintf("mount | grep %v | xargs echo", mountpoint)}, "")
+	// Bind mount of missing source fails, download dir is created on first use.
+	if err := os.MkdirAll(m.conf.DownloadDir, 0755); err != nil {
+		return fmt.Errorf("Failed create download dir: %v", err)
+	}
+	_, err = m.rt.Run(util.DaemonSpec{
+		Name:  downloaderName,
+		Image: m.conf.DownloaderImage,
+		Env: []string{
+			"PLUK_URL=" + m.conf.PlukURL,
+			"DEBUG=true",
+			"DOWNLOAD_DIR=" + m.conf.DownloadDir,
+		},
+		Mounts: []util.DaemonMount{
+			{Source: m.conf.DownloadDir, Target: m.conf.DownloadDir},
+			{Source: "/var/lib/kubelet/pods", Target: "/var/lib/kubelet/pods", ReadOnly: true, Propagation: "shared"},
+		},
+		HostNetwork: true,
+		Labels:      map[string]string{configLabel: want},
+		Restart:     true,
+	})
 	if err != nil {
-		return false, err
-	}
-	if strings.Contains(string(out), mountpoint) {
-		return true, nil
-	} else {
-		return false, nil
+		return fmt.Errorf("Failed start downloader: %v", err)
 	}
+	time.Sleep(downloaderStartWait)
+	return nil
 }
 
 func (m *Mount) Mount(path string) error {
@@ -118,80 +178,40 @@ func (m *Mount) Mount(path string) error {
 		return nil
 	}
 
-	cmd := exec.Command(
-		"sh",
-		"-c",
-		fmt.Sprintf("mount | grep %v", path),
-	)
-	out, _ := cmd.CombinedOutput()
-	if strings.Contains(string(out), path) {
-		// Already mounted
-		return nil
-	}
-
 	if err := m.EnsureDownloaderContainer(); err != nil {
 		return err
 	}
 
-	var objectWorkspace string
-	var secretWorkspace string
-	if obj, ok := m.conf["object_workspace"]; ok {
-		objectWorkspace = obj.(string)
-		secretRaw, ok := m.conf["secret_workspace"]
-		if !ok {
-			return fmt.Errorf("secret_workspace required")
-		}
-		secretWorkspace = secretRaw.(string)
-	} else {
+	objectWorkspace := m.conf.ObjectWorkspace
+	secretWorkspace := m.conf.SecretWorkspace
+	if objectWorkspace == "" {
 		// Fallback on old version: just workspace
-		ws, ok := m.conf["workspace"]
-		if !ok {
-			return fmt.Errorf("workspace or (object_workspace and secret_workspace) required")
-		}
-		objectWorkspace = ws.(string)
-		secretWorkspace = ws.(string)
+		objectWorkspace = m.conf.Workspace
+		secretWorkspace = m.conf.Workspace
 	}
 
 	url := fmt.Sprintf(
-		"http://127.0.0.1:8084/v1/download/%v/%v/%v",
-		objectWorkspace, m.conf["dataset"], m.conf["version"],
+		"%v/%v/%v/%v",
+		strings.TrimSuffix(m.conf.DownloaderURL, "/"), objectWorkspace, m.conf.Dataset, m.conf.Version,
 	)
 
-	var password = ""
-	if _, ok := m.conf["kubernetes.io/secret/token"]; ok {
-		token, err := util.GetSecretString(m.conf, "token")
-		if err != nil {
-			return err
-		}
-		password = token
-	}
-	// http://127.0.0.1:8084/v1/download/{object_workspace}/{dataset}/{version}
-	// -H "X-Workspace-Name: <secret_workspace>" -H "X-Workspace-Secret: $secret"
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+	d := &downloader{
+		url:       url,
+		workspace: secretWorkspace,
+		secret:    m.conf.Token,
+		client:    http.DefaultClient,
 	}
-	req.Header.Set("X-Workspace-Name", fmt.Sprintf("%v", secretWorkspace))
-	req.Header.Set("X-Workspace-Secret", password)
-
-	resp, err := http.DefaultClient.Do(req)
+	dir, err := m.download(d, m.conf.DownloadTimeout)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode >= 400 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("%v: %v", resp.StatusCode, string(data))
-	}
-
-	data, err := ioutil.ReadAll(resp.Body)
+	datasetPath, err := m.checkDatasetDir(dir)
 	if err != nil {
 		return err
 	}
 
-	datasetPath := string(data)
 	// mount --rbind <dataset-path> <mount-path> -o ro
-	out, err = util.ExecCommand(
+	out, err := util.ExecCommand(
 		m.exec,
 		"mount",
 		[]string{
@@ -221,5 +241,11 @@ func (m *Mount) UnMount(path string) error {
 	} else if !isMounted {
 		return nil
 	}
-	return syscall.Unmount(path, 0)
+	// Dataset is mounted with --rbind, so release all submounts too.
+	out, err := util.ExecCommand(m.exec, "umount", []string{"--recursive", path}, "")
+	if err != nil {
+		m.slog.Warning(fmt.Sprintf("Failed unmount '%s' out='%v' error='%v', detaching", path, string(out), err))
+		return syscall.Unmount(path, syscall.MNT_DETACH)
+	}
+	return nil
 }
@@ -0,0 +1,106 @@
+package download
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+func newTestMount(t *testing.T, rt util.DaemonRuntime) *Mount {
+	share.LockStateDir = t.TempDir()
+	downloaderStartWait = 0
+	conf := &Config{
+		Daemon:          share.Daemon{Runtime: util.RuntimeDocker},
+		PlukURL:         "http://127.0.0.1:30802/pluk/v1",
+		DownloaderImage: "kuberlab/pluk-downloader:latest",
+		DownloadDir:     filepath.Join(t.TempDir(), "pluk-tmp"),
+	}
+	return NewDownloadMount(util.FakeLogger{T: t}, nil, rt, conf)
+}
+
+func TestEnsureDownloaderContainer(t *testing.T) {
+	rt := util.NewFakeDaemonRuntime()
+	m := newTestMount(t, rt)
+	if err := m.EnsureDownloaderContainer(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(m.conf.DownloadDir); err != nil || !fi.IsDir() {
+		t.Fatalf("download dir is not created: %v", err)
+	}
+	st, err := rt.Inspect(downloaderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := rt.Daemons[st.ID].Spec
+	if spec.Mounts[0].Source != m.conf.DownloadDir || spec.Mounts[0].Target != m.conf.DownloadDir {
+		t.Errorf("got download dir mount %+v", spec.Mounts[0])
+	}
+
+	// Running downloader with the same settings is reused.
+	if err := m.EnsureDownloaderContainer(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Daemons) != 1 {
+		t.Fatalf("got %d downloaders, want 1", len(rt.Daemons))
+	}
+
+	// Downloader is restarted when its settings change.
+	m.conf.DownloaderImage = "kuberlab/pluk-downloader:1.1"
+	if err := m.EnsureDownloaderContainer(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rt.Daemons) != 1 {
+		t.Fatalf("got %d downloaders, want 1", len(rt.Daemons))
+	}
+	st, err = rt.Inspect(downloaderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := rt.Daemons[st.ID].Spec.Image; image != m.conf.DownloaderImage {
+		t.Errorf("got image %s, want %s", image, m.conf.DownloaderImage)
+	}
+}
+
+func TestDownloaderNodeOptions(t *testing.T) {
+	c := map[string]interface{}{
+		"kuberlabFS":              "download",
+		"kubernetes.io/readwrite": "ro",
+		"workspace":               "ws",
+		"dataset":                 "ds",
+		"version":                 "1.0.0",
+	}
+	cases := []struct {
+		node map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{}, ""},
+		{map[string]interface{}{"download_dir": "/pluk-tmp/datasets"}, ""},
+		{map[string]interface{}{"download_dir": "/data", "download_root": "/data"}, ""},
+		{map[string]interface{}{"download_dir": "/etc"}, "'download_dir' must be an absolute path in '/pluk-tmp'"},
+		{map[string]interface{}{"download_dir": "/pluk-tmp/../etc"}, "'download_dir' must be an absolute path in '/pluk-tmp'"},
+		{map[string]interface{}{"download_dir": "pluk-tmp"}, "'download_dir' must be an absolute path in '/pluk-tmp'"},
+	}
+	for _, tc := range cases {
+		_, err := share.NewShareWithExec(util.FakeLogger{T: t}, nil, share.NodeConfig{"download": tc.node}, c)
+		if tc.want == "" && err != nil {
+			t.Errorf("%v: %v", tc.node, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%v: got %v, want %s", tc.node, err, tc.want)
+		}
+	}
+
+	// Downloader is shared, a volume can't start it with its own settings.
+	for _, name := range []string{"pluk_url", "downloader_image", "download_dir", "download_root"} {
+		c[name] = "/tmp"
+		_, err := share.NewShareWithExec(util.FakeLogger{T: t}, nil, share.NodeConfig{}, c)
+		if err == nil || !strings.Contains(err.Error(), "'"+name+"' can be set only in node config") {
+			t.Errorf("volume %s: got %v, want refusal", name, err)
+		}
+		delete(c, name)
+	}
+}
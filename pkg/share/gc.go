@@ -0,0 +1,220 @@
+package share
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// GCGracePeriod spares daemons started recently, their mounts may be in progress.
+var GCGracePeriod = 5 * time.Minute
+
+// GCRemoved is a mount daemon or helper removed by GC. Helpers are
+// reported with runtime helper and their pid as ID.
+type GCRemoved struct {
+	ID      string `json:"id"`
+	Runtime string `json:"runtime"`
+	Helper  string `json:"helper,omitempty"`
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+}
+
+// gcHelperRuntime is reported as runtime of removed helpers.
+const gcHelperRuntime = "helper"
+
+// GCResult reports GC run, nothing is removed in dry run.
+type GCResult struct {
+	DryRun  bool        `json:"dryRun,omitempty"`
+	Removed []GCRemoved `json:"removed"`
+	Kept    int         `json:"kept"`
+	Errors  []string    `json:"errors,omitempty"`
+}
+
+// podVolumeRe matches volume paths of kubelet, group is the pod directory.
+var podVolumeRe = regexp.MustCompile(`^(.*/pods/[^/]+)/volumes/`)
+
+// orphanReason tells why daemon serving path is orphaned, empty if it is not.
+func orphanReason(path string) (string, error) {
+	if m := podVolumeRe.FindStringSubmatch(path); m != nil {
+		if _, err := os.Stat(m[1]); os.IsNotExist(err) {
+			return "pod is gone", nil
+		}
+	}
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return "path does not exist", nil
+	}
+	mounted, err := util.IsMounted(path)
+	if err != nil {
+		return "", err
+	}
+	if !mounted {
+		return "path is not mounted", nil
+	}
+	return "", nil
+}
+
+// NodeRuntimes returns names of container runtimes backends use on the node.
+func NodeRuntimes(node NodeConfig) []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make(map[string]bool)
+	for fs, b := range backends {
+		for _, o := range b.options {
+			if o.Name != "runtime" {
+				continue
+			}
+			runtime := o.Default
+			if v, ok := node.withDefaults(fs, nil)[o.Name]; ok {
+				runtime = fmt.Sprint(v)
+			}
+			names[runtime] = true
+		}
+	}
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// GC removes mount daemons and helpers whose mount path is gone or not
+// mounted anymore, e.g. kubelet removed pod directory without calling
+// unmount. Daemons of every runtime used on the node are checked.
+func GC(slog util.Logger, exec util.Interface, node NodeConfig, dryRun bool) *GCResult {
+	res := &GCResult{DryRun: dryRun, Removed: []GCRemoved{}}
+	for _, name := range NodeRuntimes(node) {
+		rt, err := util.NewDaemonRuntime(name, exec)
+		if err != nil {
+			res.Errors = append(res.Errors, err.Error())
+			continue
+		}
+		gcRuntime(slog, name, rt, res)
+	}
+	gcHelpers(slog, res)
+	return res
+}
+
+// gcRuntime collects daemons of runtime rt into res.
+func gcRuntime(slog util.Logger, name string, rt util.DaemonRuntime, res *GCResult) {
+	ids, err := rt.Find(map[string]string{util.MountPathLabel: ""})
+	if err != nil {
+		res.Errors = append(res.Errors, fmt.Sprintf("Failed list %s daemons: %v", name, err))
+		return
+	}
+	for _, id := range ids {
+		st, err := rt.Inspect(id)
+		if err == util.ErrDaemonNotFound {
+			continue
+		} else if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("Failed inspect %s daemon %s: %v", name, id, err))
+			continue
+		}
+		path := st.Labels[util.MountPathLabel]
+		if !st.Exited() && time.Since(st.StartedAt) < GCGracePeriod {
+			res.Kept++
+			continue
+		}
+		reason, err := orphanReason(path)
+		stale := false
+		if err == nil && reason == "" && st.Exited() {
+			// FUSE mount of exited daemon is still listed as mounted.
+			if stale, err = util.IsStaleMount(path); stale {
+				reason = "mount is stale"
+			}
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("Failed check '%s': %v", path, err))
+			continue
+		}
+		if reason == "" {
+			res.Kept++
+			continue
+		}
+		if !res.DryRun {
+			if err := util.StopDaemon(id, rt); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+				continue
+			}
+			if stale {
+				if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+					res.Errors = append(res.Errors, fmt.Sprintf("Failed detach stale mount '%s': %v", path, err))
+				}
+			}
+			if err := RemoveRecord(path); err != nil {
+				slog.Warning(err.Error())
+			}
+			slog.Info(fmt.Sprintf("Removed daemon %s of '%s': %s", id, path, reason))
+		}
+		res.Removed = append(res.Removed, GCRemoved{ID: id, Runtime: name, Path: path, Reason: reason})
+	}
+}
+
+// gcHelpers collects helper processes into res. Pid files of helpers
+// which are not running anymore are removed silently.
+func gcHelpers(slog util.Logger, res *GCResult) {
+	files, err := ioutil.ReadDir(HelperStateDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			res.Errors = append(res.Errors, fmt.Sprintf("Failed list helpers: %v", err))
+		}
+		return
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".pid" {
+			continue
+		}
+		pidFile := filepath.Join(HelperStateDir, f.Name())
+		data, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		name, path, ok := helperProcess(pid)
+		if !ok || helperPidFile(name, path) != pidFile {
+			if !res.DryRun {
+				os.Remove(pidFile)
+			}
+			continue
+		}
+		if time.Since(f.ModTime()) < GCGracePeriod {
+			res.Kept++
+			continue
+		}
+		reason, err := orphanReason(path)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("Failed check '%s': %v", path, err))
+			continue
+		}
+		if reason == "" {
+			res.Kept++
+			continue
+		}
+		if !res.DryRun {
+			if err := StopHelper(name, path); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+				continue
+			}
+			if err := RemoveRecord(path); err != nil {
+				slog.Warning(err.Error())
+			}
+			slog.Info(fmt.Sprintf("Stopped helper %s pid %d of '%s': %s", name, pid, path, reason))
+		}
+		res.Removed = append(res.Removed, GCRemoved{
+			ID:      strconv.Itoa(pid),
+			Runtime: gcHelperRuntime,
+			Helper:  name,
+			Path:    path,
+			Reason:  reason,
+		})
+	}
+}
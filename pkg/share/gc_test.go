@@ -0,0 +1,88 @@
+package share
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// startFakeHelper starts process with command line of a helper serving
+// path: shell running script named helper from a temp dir.
+func startFakeHelper(t *testing.T, name string, path string) *exec.Cmd {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "helper"), []byte("sleep 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &exec.Cmd{Path: "/bin/sh", Args: []string{"share", "helper", name, path}, Dir: dir}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	if err := os.MkdirAll(HelperStateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(helperPidFile(name, path), []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestGCHelpers(t *testing.T) {
+	HelperStateDir = t.TempDir()
+	RecordStateDir = t.TempDir()
+	old := GCGracePeriod
+	GCGracePeriod = 0
+	defer func() {
+		GCGracePeriod = old
+	}()
+
+	gone := filepath.Join(t.TempDir(), "gone")
+	orphan := startFakeHelper(t, "gitsync", gone)
+	exited := make(chan struct{})
+	go func() {
+		orphan.Wait()
+		close(exited)
+	}()
+	// Pid file of a helper which exited long ago.
+	dead := helperPidFile("s3fuse", gone)
+	if err := ioutil.WriteFile(dead, []byte("999999999"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res := &GCResult{DryRun: true}
+	gcHelpers(util.FakeLogger{T: t}, res)
+	if len(res.Removed) != 1 || len(res.Errors) != 0 {
+		t.Fatalf("dry run: got %+v", res)
+	}
+
+	res = &GCResult{}
+	gcHelpers(util.FakeLogger{T: t}, res)
+	if len(res.Errors) != 0 {
+		t.Fatalf("got errors %v", res.Errors)
+	}
+	want := GCRemoved{ID: strconv.Itoa(orphan.Process.Pid), Runtime: gcHelperRuntime, Helper: "gitsync", Path: gone, Reason: "path does not exist"}
+	if len(res.Removed) != 1 || res.Removed[0] != want {
+		t.Fatalf("got removed %+v, want %+v", res.Removed, want)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("helper is not stopped")
+	}
+	files, err := ioutil.ReadDir(HelperStateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("got %d pid files left", len(files))
+	}
+}
@@ -0,0 +1,79 @@
+package git
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// authEnv prepares environment which makes git authenticate to the remote.
+// Credentials are passed only through environment and root-only files,
+// so they never get to .git/config, command line or error messages.
+// Returned cleanup removes the files.
+func (m *GitFSMount) authEnv() ([]string, func(), error) {
+	var env []string
+	var files []string
+	var release []func()
+	cleanup := func() {
+		for _, r := range release {
+			r()
+		}
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+
+	if password := m.conf.password(); password != "" {
+		// Basic auth header through GIT_CONFIG_* variables (git >= 2.31).
+		// It is scoped to the volume URL, so submodules and redirects
+		// elsewhere don't get it.
+		auth := base64.StdEncoding.EncodeToString([]byte(m.conf.username() + ":" + password))
+		release = append(release, util.AddSecret(auth))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+m.conf.URL+".extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	if m.conf.SSHKey != "" {
+		key, err := util.WriteSecretFile("git-key", []byte(strings.TrimSpace(m.conf.SSHKey)+"\n"))
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("Failed write ssh key: %v", err)
+		}
+		files = append(files, key)
+		ssh := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes", key)
+		if m.conf.KnownHosts != "" {
+			hosts, err := util.WriteSecretFile("git-known-hosts", []byte(m.conf.KnownHosts+"\n"))
+			if err != nil {
+				cleanup()
+				return nil, func() {}, fmt.Errorf("Failed write known hosts: %v", err)
+			}
+			files = append(files, hosts)
+			ssh += fmt.Sprintf(" -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", hosts)
+		} else {
+			m.slog.Warning(fmt.Sprintf("Host key of %s is not pinned, set ssh_known_hosts secret", m.conf.URL))
+			ssh += " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no"
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+	// Never ask for credentials on terminal.
+	env = append(env, "GIT_TERMINAL_PROMPT=0")
+	return env, cleanup, nil
+}
+
+func (c *Config) username() string {
+	if c.Username != "" {
+		return c.Username
+	}
+	return "oauth2"
+}
+
+func (c *Config) password() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	return c.Password
+}
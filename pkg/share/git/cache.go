@@ -0,0 +1,337 @@
+package git
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// Repositories are cached on the node as bare repositories keyed by URL.
+// Clones in tmpfs hold only working tree and borrow objects from the cache
+// through alternates, so mounting the same repository again fetches only
+// new commits. Every mount still fetches with its own credentials, so
+// a volume can't get repository content it has no access to.
+// Alternates point to the node path, which pods don't see, so history of
+// cached clones is readable only on the node. Cache is off by default.
+// It is a variable so tests can keep the cache in a temp dir.
+var CacheDir = share.StateDir + "/git-cache"
+
+// cacheLockTimeout limits waiting for another mount updating the same repository.
+const cacheLockTimeout = 10 * time.Minute
+
+var cacheRefSpecs = []string{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// useCache tells whether the clone goes through the node cache. Shallow
+// clones bypass it, cache holds full history of every branch and tag, so
+// checkout from it would not be limited by depth.
+func (c *Config) useCache() bool {
+	return c.Cache && c.Depth == 0
+}
+
+func cacheDir(url string) string {
+	return filepath.Join(CacheDir, fmt.Sprintf("%x.git", sha1.Sum([]byte(url))))
+}
+
+// lockCache locks cached repository of the URL. Returned release
+// marks the repository used and unlocks it.
+func (m *GitFSMount) lockCache() (string, func(), error) {
+	dir := cacheDir(m.conf.URL)
+	if err := os.MkdirAll(CacheDir, 0700); err != nil {
+		return "", nil, err
+	}
+	lock, err := util.Lock(context.Background(), strings.TrimSuffix(dir, ".git")+".lock", cacheLockTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, func() {
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+		lock.Unlock()
+	}, nil
+}
+
+func usersDir(dir string) string {
+	return strings.TrimSuffix(dir, ".git") + ".users"
+}
+
+// addCacheUser records that mount at path borrows objects from the cache.
+func (m *GitFSMount) addCacheUser(path string) error {
+	users := usersDir(cacheDir(m.conf.URL))
+	if err := os.MkdirAll(users, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(users, fmt.Sprintf("%x", sha1.Sum([]byte(path)))), []byte(path), 0600)
+}
+
+func (m *GitFSMount) removeCacheUser(path string) error {
+	err := os.Remove(filepath.Join(usersDir(cacheDir(m.conf.URL)), fmt.Sprintf("%x", sha1.Sum([]byte(path)))))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// inUse tells whether any mount still borrows objects from cached
+// repository dir. Users which are no longer mounted are forgotten.
+func inUse(dir string) bool {
+	users := usersDir(dir)
+	files, err := ioutil.ReadDir(users)
+	if err != nil {
+		return false
+	}
+	used := false
+	for _, f := range files {
+		name := filepath.Join(users, f.Name())
+		path, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		if isMounted, _ := util.IsMounted(string(path)); isMounted {
+			used = true
+		} else {
+			os.Remove(name)
+		}
+	}
+	return used
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// evictCache removes least recently used cached repositories until
+// the cache fits budget bytes. Repository keep, repositories of mounted
+// volumes and locked ones are never removed.
+func evictCache(slog util.Logger, keep string, budget int64) {
+	files, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		return
+	}
+	type entry struct {
+		dir  string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var total int64
+	for _, f := range files {
+		if !f.IsDir() || !strings.HasSuffix(f.Name(), ".git") {
+			continue
+		}
+		e := entry{dir: filepath.Join(CacheDir, f.Name()), used: f.ModTime()}
+		e.size = dirSize(e.dir)
+		total += e.size
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	for _, e := range entries {
+		if total <= budget {
+			return
+		}
+		if e.dir == keep || inUse(e.dir) {
+			continue
+		}
+		lock, err := util.TryLock(strings.TrimSuffix(e.dir, ".git") + ".lock")
+		if err != nil {
+			continue
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			slog.Warning(fmt.Sprintf("Failed evict git cache '%s': %v", e.dir, err))
+		} else {
+			slog.Info(fmt.Sprintf("Evicted git cache '%s', %d bytes", e.dir, e.size))
+			total -= e.size
+		}
+		lock.Unlock()
+	}
+}
+
+// writeAlternates makes repository at path read objects from cache.
+func writeAlternates(path string, cache string) error {
+	info := filepath.Join(path, ".git", "objects", "info")
+	if err := os.MkdirAll(info, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(info, "alternates"), []byte(filepath.Join(cache, "objects")+"\n"), 0644)
+}
+
+// cacheRevisions lists names the revision is looked up by in the cache.
+// Branches and tags go first, so a branch named like a short hex string
+// isn't taken for a commit.
+func (c *Config) cacheRevisions() []string {
+	if c.Revision == "" {
+		return []string{"HEAD"}
+	}
+	return []string{"refs/heads/" + c.Revision, "refs/tags/" + c.Revision, c.Revision}
+}
+
+// cloneCachedNative updates cached repository and checks out
+// requested revision into path in-process.
+func (m *GitFSMount) cloneCachedNative(path string) error {
+	auth, cleanup, err := m.nativeAuth()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	cache, release, err := m.lockCache()
+	if err != nil {
+		return err
+	}
+	defer evictCache(m.slog, cache, int64(m.conf.CacheBudget)<<30)
+	defer release()
+
+	repo, err := gogit.PlainOpen(cache)
+	if err == gogit.ErrRepositoryNotExists {
+		repo, err = gogit.PlainInit(cache, true)
+	}
+	if err != nil {
+		return nativeError(err)
+	}
+	var specs []config.RefSpec
+	for _, s := range cacheRefSpecs {
+		specs = append(specs, config.RefSpec(s))
+	}
+	if _, err := repo.Remote("origin"); err == gogit.ErrRemoteNotFound {
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{m.conf.URL}, Fetch: specs})
+		if err != nil {
+			return nativeError(err)
+		}
+	}
+	err = repo.Fetch(&gogit.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   specs,
+		Auth:       auth,
+		Tags:       gogit.NoTags,
+		Force:      true,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return nativeError(err)
+	}
+	if m.conf.Revision == "" {
+		// Cache HEAD follows remote HEAD.
+		_, hash, err := m.resolveNative(auth, "HEAD")
+		if err != nil {
+			return err
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash)); err != nil {
+			return nativeError(err)
+		}
+	}
+	var hash *plumbing.Hash
+	for _, rev := range m.conf.cacheRevisions() {
+		if hash, err = repo.ResolveRevision(plumbing.Revision(rev)); err == nil {
+			break
+		}
+	}
+	if hash == nil || err != nil {
+		return cloneError(ErrRefNotFound, "Revision '%s' not found in %s", m.conf.Revision, m.conf.URL)
+	}
+
+	if _, err := gogit.PlainInit(path, false); err != nil {
+		return nativeError(err)
+	}
+	if err := writeAlternates(path, cache); err != nil {
+		return err
+	}
+	work, err := gogit.PlainOpen(path)
+	if err != nil {
+		return nativeError(err)
+	}
+	_, err = work.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{m.conf.URL}})
+	if err != nil {
+		return nativeError(err)
+	}
+	return m.checkoutNative(work, *hash, auth)
+}
+
+// cloneCachedBinary is cloneCachedNative done with git binary.
+func (m *GitFSMount) cloneCachedBinary(path string) error {
+	if _, err := m.exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git binary is not found on the node, use native clone: %v", err)
+	}
+	env, cleanup, err := m.authEnv()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	m.env = env
+	defer func() {
+		m.env = nil
+	}()
+	cache, release, err := m.lockCache()
+	if err != nil {
+		return err
+	}
+	defer evictCache(m.slog, cache, int64(m.conf.CacheBudget)<<30)
+	defer release()
+
+	if _, err := os.Stat(filepath.Join(cache, "HEAD")); os.IsNotExist(err) {
+		if _, err := m.git("", "init", "-q", "--bare", cache); err != nil {
+			return err
+		}
+	}
+	args := append([]string{"fetch", "-q", "--prune", "--force", m.conf.URL}, cacheRefSpecs...)
+	if _, err := m.git(cache, args...); err != nil {
+		return err
+	}
+	if m.conf.Revision == "" {
+		// Cache HEAD follows remote HEAD.
+		sha, err := m.resolveRemote("HEAD")
+		if err != nil {
+			return err
+		}
+		if _, err := m.git(cache, "update-ref", "--no-deref", "HEAD", sha); err != nil {
+			return err
+		}
+	}
+	commit := ""
+	for _, rev := range m.conf.cacheRevisions() {
+		if out, err := m.git(cache, "rev-parse", "-q", "--verify", rev+"^{commit}"); err == nil {
+			commit = strings.TrimSpace(string(out))
+			break
+		}
+	}
+	if commit == "" {
+		return cloneError(ErrRefNotFound, "Revision '%s' not found in %s", m.conf.Revision, m.conf.URL)
+	}
+
+	if _, err := m.git(path, "init", "-q"); err != nil {
+		return err
+	}
+	if err := writeAlternates(path, cache); err != nil {
+		return err
+	}
+	if _, err := m.git(path, "remote", "add", "origin", m.conf.URL); err != nil {
+		return err
+	}
+	if len(m.conf.Sparse) > 0 {
+		if err := m.sparseCheckout(path); err != nil {
+			return err
+		}
+	}
+	return m.checkoutBinary(path, commit, commit)
+}
@@ -0,0 +1,220 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var shaRe = regexp.MustCompile("^[0-9a-f]{4,40}$")
+
+func isSHA(rev string) bool {
+	return shaRe.MatchString(rev)
+}
+
+func (m *GitFSMount) git(dir string, args ...string) ([]byte, error) {
+	cmd := m.exec.Command("git", args...)
+	if len(dir) > 0 {
+		cmd.SetDir(dir)
+	}
+	if len(m.env) > 0 {
+		cmd.SetEnv(m.env)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, &CloneError{
+			Kind: binaryErrorKind(string(out)),
+			Err:  fmt.Errorf("git %s failed out='%v' error='%v'", args[0], strings.TrimSpace(string(out)), err),
+		}
+	}
+	return out, nil
+}
+
+// clone checks out requested revision of the repository into path.
+// In auto mode git binary is used only if native clone fails for
+// a reason other than bad credentials, revision or network.
+func (m *GitFSMount) clone(path string) error {
+	native, binary := m.cloneNative, m.cloneBinary
+	if m.conf.useCache() {
+		native, binary = m.cloneCachedNative, m.cloneCachedBinary
+	}
+	if m.conf.Clone == CloneBinary {
+		return binary(path)
+	}
+	err := native(path)
+	if err == nil || m.conf.Clone == CloneNative || !IsKind(err, ErrUnknown) {
+		return err
+	}
+	if _, lookErr := m.exec.LookPath("git"); lookErr != nil {
+		return err
+	}
+	m.slog.Warning(fmt.Sprintf("Native clone of %s failed: %v, trying git binary", m.conf.URL, err))
+	if err := cleanDir(path); err != nil {
+		return err
+	}
+	return binary(path)
+}
+
+// cleanDir removes everything inside of dir, but not dir itself
+// because it is the mount point.
+func cleanDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneBinary checks out requested revision of the repository into path
+// with git binary and makes sure HEAD is what was requested.
+func (m *GitFSMount) cloneBinary(path string) error {
+	if _, err := m.exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git binary is not found on the node, use native clone: %v", err)
+	}
+	env, cleanup, err := m.authEnv()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	m.env = env
+	defer func() {
+		m.env = nil
+	}()
+
+	rev := m.conf.Revision
+	if rev == "" {
+		rev = "HEAD"
+	}
+	// Branches and tags are resolved first, so a branch named like
+	// a short hex string isn't taken for a commit.
+	expected := rev
+	fetchRev := rev
+	if len(rev) != 40 || !isSHA(rev) {
+		sha, err := m.resolveRemote(rev)
+		if err == nil {
+			expected = sha
+		} else if !IsKind(err, ErrRefNotFound) || !isSHA(rev) {
+			return err
+		} else {
+			fetchRev = ""
+		}
+	}
+
+	if _, err := m.git(path, "init", "-q"); err != nil {
+		return err
+	}
+	if _, err := m.git(path, "remote", "add", "origin", m.conf.URL); err != nil {
+		return err
+	}
+	if len(m.conf.Sparse) > 0 {
+		if err := m.sparseCheckout(path); err != nil {
+			return err
+		}
+	}
+	if err := m.fetch(path, fetchRev, rev); err != nil {
+		return err
+	}
+	return m.checkoutBinary(path, "FETCH_HEAD", expected)
+}
+
+// checkoutBinary checks out commit into path with submodules
+// and makes sure HEAD matches expected prefix.
+func (m *GitFSMount) checkoutBinary(path string, commit string, expected string) error {
+	if _, err := m.git(path, "checkout", "-q", commit); err != nil {
+		return err
+	}
+	if m.conf.Submodules {
+		args := []string{"submodule", "update", "--init", "--recursive"}
+		if m.conf.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(m.conf.Depth))
+		}
+		if _, err := m.git(path, args...); err != nil {
+			return err
+		}
+	}
+
+	out, err := m.git(path, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	head := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(head, expected) {
+		return fmt.Errorf("Checked out HEAD %s doesn't match requested revision '%s' (%s)", head, m.conf.Revision, expected)
+	}
+	m.slog.Info(fmt.Sprintf("Checked out %s at %s", m.conf.URL, head))
+	return nil
+}
+
+// fetch sets FETCH_HEAD to ref. Abbreviated commit can't be fetched
+// directly, so if ref is empty all branches and tags are fetched and
+// FETCH_HEAD is pointed to commit.
+func (m *GitFSMount) fetch(path string, ref string, commit string) error {
+	if ref == "" {
+		if _, err := m.git(path, "fetch", "-q", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return err
+		}
+		out, err := m.git(path, "rev-parse", "--verify", commit+"^{commit}")
+		if err != nil {
+			return cloneError(ErrRefNotFound, "Revision '%s' not found in %s", commit, m.conf.URL)
+		}
+		_, err = m.git(path, "update-ref", "FETCH_HEAD", strings.TrimSpace(string(out)))
+		return err
+	}
+	args := []string{"fetch", "-q"}
+	if m.conf.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(m.conf.Depth))
+	}
+	_, err := m.git(path, append(args, "origin", ref)...)
+	return err
+}
+
+// sparseCheckout limits working tree to configured sub-directories.
+func (m *GitFSMount) sparseCheckout(path string) error {
+	if _, err := m.git(path, "config", "core.sparseCheckout", "true"); err != nil {
+		return err
+	}
+	var patterns []string
+	for _, p := range m.conf.Sparse {
+		patterns = append(patterns, "/"+strings.Trim(p, "/")+"/")
+	}
+	return ioutil.WriteFile(
+		filepath.Join(path, ".git", "info", "sparse-checkout"),
+		[]byte(strings.Join(patterns, "\n")+"\n"),
+		0644,
+	)
+}
+
+// resolveRemote returns commit the remote ref points to. Annotated tags are peeled.
+func (m *GitFSMount) resolveRemote(rev string) (string, error) {
+	out, err := m.git("", "ls-remote", m.conf.URL, rev, rev+"^{}")
+	if err != nil {
+		return "", err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, ref := range []string{
+		rev,
+		"refs/heads/" + rev,
+		"refs/tags/" + rev + "^{}",
+		"refs/tags/" + rev,
+	} {
+		if sha, ok := refs[ref]; ok {
+			return sha, nil
+		}
+	}
+	return "", cloneError(ErrRefNotFound, "Revision '%s' not found in %s", rev, m.conf.URL)
+}
@@ -0,0 +1,128 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// ErrorKind tells why clone failed, so it's clear whether the volume
+// configuration has to be fixed or mount can be retried.
+type ErrorKind string
+
+const (
+	ErrAuth         ErrorKind = "auth failed"
+	ErrRefNotFound  ErrorKind = "ref not found"
+	ErrRepoNotFound ErrorKind = "repository not found"
+	ErrNetwork      ErrorKind = "network"
+	ErrUnknown      ErrorKind = "unknown"
+)
+
+type CloneError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *CloneError) Error() string {
+	if e.Kind == ErrUnknown {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *CloneError) Unwrap() error {
+	return e.Err
+}
+
+// IsKind reports whether err is CloneError of given kind.
+func IsKind(err error, kind ErrorKind) bool {
+	var e *CloneError
+	return errors.As(err, &e) && e.Kind == kind
+}
+
+func cloneError(kind ErrorKind, format string, args ...interface{}) error {
+	return &CloneError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// nativeError classifies errors returned by go-git.
+func nativeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *CloneError
+	if errors.As(err, &e) {
+		return err
+	}
+	var netErr net.Error
+	kind := ErrUnknown
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		strings.Contains(err.Error(), "unable to authenticate"):
+		kind = ErrAuth
+	case errors.Is(err, plumbing.ErrReferenceNotFound),
+		errors.Is(err, gogit.ErrBranchNotFound),
+		errors.Is(err, gogit.ErrTagNotFound):
+		kind = ErrRefNotFound
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		kind = ErrRepoNotFound
+	case errors.As(err, &netErr):
+		kind = ErrNetwork
+	}
+	return &CloneError{Kind: kind, Err: err}
+}
+
+// binaryErrorKind classifies failed git command by its output.
+func binaryErrorKind(out string) ErrorKind {
+	out = strings.ToLower(out)
+	for _, s := range []string{
+		"authentication failed",
+		"could not read username",
+		"could not read password",
+		"permission denied",
+		"host key verification failed",
+		"returned error: 401",
+		"returned error: 403",
+	} {
+		if strings.Contains(out, s) {
+			return ErrAuth
+		}
+	}
+	for _, s := range []string{
+		"couldn't find remote ref",
+		"unknown revision",
+		"not a valid object name",
+		"did not match any",
+	} {
+		if strings.Contains(out, s) {
+			return ErrRefNotFound
+		}
+	}
+	for _, s := range []string{
+		"could not resolve host",
+		"connection refused",
+		"connection timed out",
+		"network is unreachable",
+		"could not connect",
+	} {
+		if strings.Contains(out, s) {
+			return ErrNetwork
+		}
+	}
+	for _, s := range []string{
+		"repository not found",
+		"does not appear to be a git repository",
+		"returned error: 404",
+	} {
+		if strings.Contains(out, s) {
+			return ErrRepoNotFound
+		}
+	}
+	return ErrUnknown
+}
@@ -1,37 +1,177 @@
 package git
 
 import (
+	"crypto/sha1"
 	"fmt"
-	"log/syslog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/kuberlab/s3share/pkg/share"
 	"github.com/kuberlab/s3share/pkg/util"
 )
 
 type GitFSMount struct {
-	slog *syslog.Writer
+	slog util.Logger
 	exec util.Interface
-	conf map[string]interface{}
+	conf *Config
+	// env is passed to every git command, see authEnv.
+	env []string
 }
 
-func NewGitFSMount(slog *syslog.Writer, conf map[string]interface{}) *GitFSMount {
-	return &GitFSMount{slog: slog, conf: conf, exec: util.NewExec()}
+type Config struct {
+	share.Access
+	URL          string        `share:"url,required" description:"Repository URL"`
+	Revision     string        `share:"revision" description:"Branch, tag or commit to check out, remote HEAD by default"`
+	Depth        int           `share:"depth" description:"Fetch only given number of commits"`
+	Submodules   bool          `share:"submodules" description:"Check out submodules recursively"`
+	Sparse       []string      `share:"sparse" description:"Comma separated directories to check out"`
+	Clone        string        `share:"clone" default:"auto" description:"Clone in-process (native), with git binary on the node (binary) or native with binary fallback (auto)"`
+	SyncInterval time.Duration `share:"syncInterval" description:"Follow the revision on the remote, checkout is then available under current directory of the volume"`
+	Cache        bool          `share:"cache" description:"Keep repository objects in node cache shared by volumes of the same URL, not used with depth. Git in pods can't read history of such clones"`
+	CacheBudget  int           `share:"cache_budget" default:"10" description:"Disk space in GiB node cache may take, least recently used repositories are removed above it"`
+	SizeLimit    string        `share:"sizeLimit" description:"Size of tmpfs holding the clone, e.g. 512Mi, 2g or 10%, half of node RAM by default"`
+
+	Username   string `share:"git_username,secret" description:"User for HTTPS basic auth"`
+	Password   string `share:"git_password,secret" description:"Password for HTTPS basic auth"`
+	Token      string `share:"git_token,secret" description:"Access token for HTTPS auth"`
+	SSHKey     string `share:"ssh_private_key,secret" description:"Private key for SSH auth"`
+	KnownHosts string `share:"ssh_known_hosts,secret" description:"known_hosts lines to pin SSH host key"`
+}
+
+const (
+	CloneAuto   = "auto"
+	CloneNative = "native"
+	CloneBinary = "binary"
+)
+
+// MarkerStateDir holds markers of clones which completed successfully.
+const MarkerStateDir = share.StateDir + "/git"
+
+// StagingStateDir holds writable tmpfs of read-only volumes with
+// syncInterval, see workRoot.
+const StagingStateDir = share.StateDir + "/git-staging"
+
+var sizeRe = regexp.MustCompile(`^([0-9]+)([kmgKMG]i?|%)?$`)
+
+// tmpfsSize converts size limit to tmpfs size option, Kubernetes
+// quantity suffixes Ki, Mi and Gi are accepted as well.
+func tmpfsSize(limit string) (string, bool) {
+	m := sizeRe.FindStringSubmatch(limit)
+	if m == nil {
+		return "", false
+	}
+	return m[1] + strings.ToLower(strings.TrimSuffix(m[2], "i")), true
+}
+
+func (c *Config) Validate() error {
+	var errs share.ConfigError
+	if c.Clone != CloneAuto && c.Clone != CloneNative && c.Clone != CloneBinary {
+		errs = append(errs, fmt.Sprintf("'clone' must be %s, %s or %s", CloneAuto, CloneNative, CloneBinary))
+	}
+	if _, ok := tmpfsSize(c.SizeLimit); c.SizeLimit != "" && !ok {
+		errs = append(errs, fmt.Sprintf("'sizeLimit' must be a number with optional k, m, g or %% suffix: '%s'", c.SizeLimit))
+	}
+	if c.SyncInterval < 0 {
+		errs = append(errs, "'syncInterval' must not be negative")
+	}
+	if c.Depth < 0 {
+		errs = append(errs, "'depth' must not be negative")
+	}
+	if c.CacheBudget < 0 {
+		errs = append(errs, "'cache_budget' must not be negative")
+	}
+	if c.Password != "" && c.Token != "" {
+		errs = append(errs, "only one of 'git_password' and 'git_token' can be set")
+	}
+	if c.Password != "" && c.Username == "" {
+		errs = append(errs, "'git_username' is required with 'git_password'")
+	}
+	if c.KnownHosts != "" && c.SSHKey == "" {
+		errs = append(errs, "'ssh_known_hosts' needs 'ssh_private_key'")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func init() {
+	share.Register("git", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &Config{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		return NewGitFSMount(slog, exec, conf), nil
+	}, &Config{})
+}
+
+func NewGitFSMount(slog util.Logger, exec util.Interface, conf *Config) *GitFSMount {
+	return &GitFSMount{slog: slog, conf: conf, exec: exec}
+}
+
+func markerFile(path string) string {
+	return filepath.Join(MarkerStateDir, fmt.Sprintf("%x.done", sha1.Sum([]byte(path))))
+}
+
+func stagingDir(path string) string {
+	return filepath.Join(StagingStateDir, fmt.Sprintf("%x", sha1.Sum([]byte(path))))
+}
+
+// workRoot returns where the clone of the volume at path is written.
+// Read-only volume with syncInterval is a read-only bind of tmpfs
+// mounted writable in the staging dir, so sync updates it while pods
+// never see the volume writable.
+func (m *GitFSMount) workRoot(path string) string {
+	if m.conf.SyncInterval > 0 && m.conf.ReadOnly() {
+		return stagingDir(path)
+	}
+	return path
 }
 
 func (m *GitFSMount) Mount(path string) error {
-	if isMounted, err := util.IsMounted(path); err != nil {
+	if mnt, err := util.FindMount(path); err != nil {
 		return fmt.Errorf("Failed test mount %v", err)
-	} else if isMounted {
-		return nil
+	} else if mnt != nil {
+		if mnt.FSType != "tmpfs" {
+			return fmt.Errorf("'%s' is already mounted with %s from '%s'", path, mnt.FSType, mnt.Source)
+		}
+		if _, err := os.Stat(markerFile(path)); err == nil {
+			return nil
+		}
+		// Clone didn't complete, start over.
+		m.slog.Warning(fmt.Sprintf("Clone at '%s' is incomplete, remounting", path))
+		if err := m.UnMount(path); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(markerFile(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := m.workRoot(path)
+	if root != path {
+		if err := os.MkdirAll(root, 0700); err != nil {
+			return err
+		}
+	}
+	args := []string{"-t", "tmpfs"}
+	if size, ok := tmpfsSize(m.conf.SizeLimit); ok && size != "" {
+		args = append(args, "-o", "size="+size)
 	}
-	out, err := util.ExecCommand(m.exec, "mount", []string{"-t", "tmpfs", "tmpfs", path}, "")
+	out, err := util.ExecCommand(m.exec, "mount", append(args, "tmpfs", root), "")
 	if err != nil {
 		return fmt.Errorf("Failed mount tmpfs out='%v' error='%v'", string(out), err)
 	}
-	url := m.conf["url"].(string)
-	out, err = util.ExecCommand(m.exec, "git", []string{"clone", url, path}, path)
-	if err != nil {
-		return fmt.Errorf("Failed clone repo out='%v' error='%v'", string(out), err)
+	if err := m.populate(path); err != nil {
+		// Leave nothing which could be taken for a mounted volume.
+		if uerr := m.UnMount(path); uerr != nil {
+			m.slog.Warning(fmt.Sprintf("Failed roll back tmpfs at '%s': %v", path, uerr))
+		}
+		return err
 	}
 	if isMounted, err := util.IsMounted(path); err != nil {
 		m.slog.Warning("Can't get mount status: " + err.Error())
@@ -41,11 +181,85 @@ func (m *GitFSMount) Mount(path string) error {
 	return nil
 }
 
+// populate clones the repository into mounted tmpfs and marks the clone complete.
+func (m *GitFSMount) populate(path string) error {
+	if m.conf.useCache() {
+		if err := m.addCacheUser(path); err != nil {
+			return err
+		}
+	}
+	clone := m.clone
+	if m.conf.SyncInterval > 0 {
+		clone = m.checkout
+	}
+	root := m.workRoot(path)
+	if err := clone(root); err != nil {
+		return fmt.Errorf("Failed clone repo: %v", err)
+	}
+	if root != path {
+		if out, err := util.ExecCommand(m.exec, "mount", []string{"--bind", root, path}, ""); err != nil {
+			return fmt.Errorf("Failed bind tmpfs out='%v' error='%v'", string(out), err)
+		}
+		// Only the bind is read-only, tmpfs stays writable in the staging dir.
+		if out, err := util.ExecCommand(m.exec, "mount", []string{"-o", "remount,bind,ro", path}, ""); err != nil {
+			return fmt.Errorf("Failed remount bind read-only out='%v' error='%v'", string(out), err)
+		}
+	} else if m.conf.ReadOnly() {
+		out, err := util.ExecCommand(m.exec, "mount", []string{"-o", "remount,ro", path}, "")
+		if err != nil {
+			return fmt.Errorf("Failed remount tmpfs read-only out='%v' error='%v'", string(out), err)
+		}
+	}
+	if err := os.MkdirAll(MarkerStateDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(markerFile(path), []byte(m.conf.URL), 0600); err != nil {
+		return err
+	}
+	if m.conf.SyncInterval > 0 {
+		return m.startSync(path)
+	}
+	return nil
+}
+
 func (m *GitFSMount) UnMount(path string) error {
+	// Sync helper is stopped first so it doesn't keep the mount busy.
+	if err := share.StopHelper(syncHelper, path); err != nil {
+		m.slog.Warning(err.Error())
+	}
+	if err := m.removeCacheUser(path); err != nil {
+		m.slog.Warning(err.Error())
+	}
+	if err := os.Remove(markerFile(path)); err != nil && !os.IsNotExist(err) {
+		m.slog.Warning(err.Error())
+	}
+	// Staging tmpfs is looked for regardless of options, they may have
+	// changed since mount.
+	staging := stagingDir(path)
+	if isMounted, err := util.IsMounted(staging); err != nil {
+		m.slog.Warning(fmt.Sprintf("Failed test mount %v", err))
+	} else if isMounted {
+		if err := unmountTmpfs(m.slog, staging); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(staging); err != nil && !os.IsNotExist(err) {
+		m.slog.Warning(err.Error())
+	}
 	if isMounted, err := util.IsMounted(path); err != nil {
 		return fmt.Errorf("Failed test mount %v", err)
 	} else if !isMounted {
 		return nil
 	}
-	return syscall.Unmount(path, 0)
+	return unmountTmpfs(m.slog, path)
+}
+
+// unmountTmpfs unmounts tmpfs or its bind, which releases memory used by
+// the clone once the last of them is gone. Busy mount is detached.
+func unmountTmpfs(slog util.Logger, path string) error {
+	if err := syscall.Unmount(path, 0); err != nil {
+		slog.Warning(fmt.Sprintf("Failed unmount '%s': %v, detaching", path, err))
+		return syscall.Unmount(path, syscall.MNT_DETACH)
+	}
+	return nil
 }
@@ -0,0 +1,237 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// cloneNative checks out requested revision into path in-process,
+// without git binary on the node.
+func (m *GitFSMount) cloneNative(path string) error {
+	auth, cleanup, err := m.nativeAuth()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	rev := m.conf.Revision
+	if rev == "" {
+		rev = "HEAD"
+	}
+	opts := &gogit.CloneOptions{
+		URL:        m.conf.URL,
+		Auth:       auth,
+		NoCheckout: true,
+		Tags:       gogit.NoTags,
+	}
+	// Branches and tags are resolved first, so a branch named like
+	// a short hex string isn't taken for a commit.
+	ref, _, err := m.resolveNative(auth, rev)
+	if err == nil {
+		opts.ReferenceName = ref
+		opts.SingleBranch = true
+		opts.Depth = m.conf.Depth
+	} else if !IsKind(err, ErrRefNotFound) || !isSHA(rev) {
+		return err
+	} else {
+		// Commit can be looked up only in full history.
+		opts.Tags = gogit.AllTags
+	}
+
+	repo, err := gogit.PlainClone(path, false, opts)
+	if err != nil {
+		return nativeError(err)
+	}
+	resolve := rev
+	if ref != "" {
+		resolve = ref.String()
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(resolve))
+	if err != nil {
+		return cloneError(ErrRefNotFound, "Revision '%s' not found in %s", rev, m.conf.URL)
+	}
+	return m.checkoutNative(repo, *hash, auth)
+}
+
+// checkoutNative checks out commit hash into worktree of repo
+// and makes sure HEAD is what was requested.
+func (m *GitFSMount) checkoutNative(repo *gogit.Repository, hash plumbing.Hash, auth transport.AuthMethod) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return nativeError(err)
+	}
+	var sparse []string
+	for _, p := range m.conf.Sparse {
+		sparse = append(sparse, strings.Trim(p, "/"))
+	}
+	err = w.Checkout(&gogit.CheckoutOptions{
+		Hash:                      hash,
+		SparseCheckoutDirectories: sparse,
+	})
+	if err != nil {
+		return nativeError(err)
+	}
+	if m.conf.Submodules {
+		if err := m.updateSubmodules(w, auth, gogit.DefaultSubmoduleRecursionDepth); err != nil {
+			return nativeError(err)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nativeError(err)
+	}
+	if head.Hash() != hash {
+		return fmt.Errorf("Checked out HEAD %s doesn't match requested revision '%s' (%s)", head.Hash(), m.conf.Revision, hash)
+	}
+	m.slog.Info(fmt.Sprintf("Checked out %s at %s", m.conf.URL, head.Hash()))
+	return nil
+}
+
+// updateSubmodules checks out submodules of w, recursing depth levels.
+// Credentials of the volume are sent only to submodules on the host of
+// its URL, others are fetched anonymously.
+func (m *GitFSMount) updateSubmodules(w *gogit.Worktree, auth transport.AuthMethod, depth gogit.SubmoduleRescursivity) error {
+	subs, err := w.Submodules()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if err := sub.Init(); err != nil && err != gogit.ErrSubmoduleAlreadyInitialized {
+			return err
+		}
+		// Repository resolves relative submodule URL against the parent remote.
+		r, err := sub.Repository()
+		if err != nil {
+			return err
+		}
+		remote, err := r.Remote(gogit.DefaultRemoteName)
+		if err != nil {
+			return err
+		}
+		var subAuth transport.AuthMethod
+		if sameHost(m.conf.URL, remote.Config().URLs[0]) {
+			subAuth = auth
+		}
+		err = sub.Update(&gogit.SubmoduleUpdateOptions{
+			RecurseSubmodules: gogit.NoRecurseSubmodules,
+			Auth:              subAuth,
+			Depth:             m.conf.Depth,
+		})
+		if err != nil {
+			return err
+		}
+		if depth > 1 {
+			if sw, err := r.Worktree(); err != nil {
+				return err
+			} else if err := m.updateSubmodules(sw, auth, depth-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sameHost reports whether URLs a and b have the same protocol, host
+// and port, so credentials of one may be sent to the other.
+func sameHost(a, b string) bool {
+	ea, err := transport.NewEndpoint(a)
+	if err != nil {
+		return false
+	}
+	eb, err := transport.NewEndpoint(b)
+	if err != nil {
+		return false
+	}
+	return ea.Protocol == eb.Protocol && strings.EqualFold(ea.Host, eb.Host) && ea.Port == eb.Port
+}
+
+// resolveNative finds full name of the remote branch or tag and
+// commit it points to. Annotated tags are peeled.
+func (m *GitFSMount) resolveNative(auth transport.AuthMethod, rev string) (plumbing.ReferenceName, plumbing.Hash, error) {
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{m.conf.URL},
+	})
+	refs, err := remote.List(&gogit.ListOptions{Auth: auth, PeelingOption: gogit.AppendPeeled})
+	if err != nil {
+		return "", plumbing.ZeroHash, nativeError(err)
+	}
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(rev),
+		plumbing.NewBranchReferenceName(rev),
+		plumbing.NewTagReferenceName(rev),
+	} {
+		r, ok := byName[name]
+		if !ok {
+			continue
+		}
+		if r.Type() == plumbing.SymbolicReference {
+			if target, ok := byName[r.Target()]; ok {
+				r = target
+			}
+		}
+		hash := r.Hash()
+		if peeled, ok := byName[name+"^{}"]; ok {
+			hash = peeled.Hash()
+		}
+		if name == plumbing.HEAD {
+			// Clone follows remote HEAD when reference is not set.
+			return "", hash, nil
+		}
+		return name, hash, nil
+	}
+	return "", plumbing.ZeroHash, cloneError(ErrRefNotFound, "Revision '%s' not found in %s", rev, m.conf.URL)
+}
+
+// nativeAuth is go-git counterpart of authEnv.
+func (m *GitFSMount) nativeAuth() (transport.AuthMethod, func(), error) {
+	cleanup := func() {}
+	if m.conf.SSHKey != "" {
+		user := ssh.DefaultUsername
+		if ep, err := transport.NewEndpoint(m.conf.URL); err == nil && ep.User != "" {
+			user = ep.User
+		}
+		auth, err := ssh.NewPublicKeys(user, []byte(strings.TrimSpace(m.conf.SSHKey)+"\n"), "")
+		if err != nil {
+			return nil, cleanup, cloneError(ErrAuth, "Invalid ssh key: %v", err)
+		}
+		if m.conf.KnownHosts == "" {
+			m.slog.Warning(fmt.Sprintf("Host key of %s is not pinned, set ssh_known_hosts secret", m.conf.URL))
+			auth.HostKeyCallback = gossh.InsecureIgnoreHostKey()
+			return auth, cleanup, nil
+		}
+		hosts, err := util.WriteSecretFile("git-known-hosts", []byte(m.conf.KnownHosts+"\n"))
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("Failed write known hosts: %v", err)
+		}
+		cleanup = func() {
+			os.Remove(hosts)
+		}
+		auth.HostKeyCallback, err = ssh.NewKnownHostsCallback(hosts)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("Invalid ssh_known_hosts: %v", err)
+		}
+		return auth, cleanup, nil
+	}
+	if password := m.conf.password(); password != "" {
+		return &http.BasicAuth{Username: m.conf.username(), Password: password}, cleanup, nil
+	}
+	return nil, cleanup, nil
+}
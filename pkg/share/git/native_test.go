@@ -0,0 +1,286 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+type testRepo struct {
+	url string
+	// commits are hashes of commits writing one, two and three to file.txt.
+	commits []plumbing.Hash
+}
+
+// newTestRepo builds bare repository with three commits on master,
+// branch dev at the second one and annotated tag v1 at the first one.
+func newTestRepo(t *testing.T) *testRepo {
+	src := t.TempDir()
+	repo, err := gogit.PlainInit(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1500000000, 0)}
+	r := &testRepo{url: filepath.Join(t.TempDir(), "repo.git")}
+	for _, content := range []string{"one", "two", "three"} {
+		if err := ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add("file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := w.Commit(content, &gogit.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.commits = append(r.commits, hash)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("dev"), r.commits[1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1", r.commits[0], &gogit.CreateTagOptions{Tagger: sig, Message: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gogit.PlainInit(r.url, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{r.url}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Push(&gogit.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func cloneNativeTo(t *testing.T, conf *Config) (string, error) {
+	path := filepath.Join(t.TempDir(), "clone")
+	m := NewGitFSMount(util.FakeLogger{T: t}, nil, conf)
+	return path, m.cloneNative(path)
+}
+
+func TestCloneNative(t *testing.T) {
+	r := newTestRepo(t)
+	cases := []struct {
+		revision string
+		depth    int
+		want     string
+	}{
+		{"", 0, "three"},
+		{"master", 1, "three"},
+		{"dev", 0, "two"},
+		{"refs/heads/dev", 0, "two"},
+		{"v1", 0, "one"},
+		{r.commits[0].String(), 0, "one"},
+		{r.commits[1].String()[:10], 0, "two"},
+	}
+	for _, c := range cases {
+		path, err := cloneNativeTo(t, &Config{URL: r.url, Revision: c.revision, Depth: c.depth})
+		if err != nil {
+			t.Errorf("revision '%s': %v", c.revision, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(path, "file.txt"))
+		if err != nil {
+			t.Errorf("revision '%s': %v", c.revision, err)
+			continue
+		}
+		if string(data) != c.want {
+			t.Errorf("revision '%s': got '%s', want '%s'", c.revision, data, c.want)
+		}
+	}
+}
+
+func TestCloneNativeMissingRevision(t *testing.T) {
+	r := newTestRepo(t)
+	for _, rev := range []string{"missing", "0123456789abcdef0123456789abcdef01234567"} {
+		_, err := cloneNativeTo(t, &Config{URL: r.url, Revision: rev})
+		if !IsKind(err, ErrRefNotFound) {
+			t.Errorf("revision '%s': got %v, want %s", rev, err, ErrRefNotFound)
+		}
+	}
+}
+
+func TestCloneNativeAuthFailed(t *testing.T) {
+	var gotAuth bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		gotAuth = gotAuth || ok
+		if !ok || user != "user" || password != "right" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	_, err := cloneNativeTo(t, &Config{URL: srv.URL + "/repo.git", Username: "user", Password: "wrong"})
+	if !IsKind(err, ErrAuth) {
+		t.Errorf("got %v, want %s", err, ErrAuth)
+	}
+	if !gotAuth {
+		t.Errorf("credentials were not sent")
+	}
+	_, err = cloneNativeTo(t, &Config{URL: srv.URL + "/repo.git"})
+	if !IsKind(err, ErrAuth) {
+		t.Errorf("without credentials: got %v, want %s", err, ErrAuth)
+	}
+}
+
+func TestCloneCache(t *testing.T) {
+	CacheDir = t.TempDir()
+	r := newTestRepo(t)
+	cached := func() int {
+		files, err := ioutil.ReadDir(CacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, f := range files {
+			if filepath.Ext(f.Name()) == ".git" {
+				n++
+			}
+		}
+		return n
+	}
+
+	m := NewGitFSMount(util.FakeLogger{T: t}, nil, &Config{URL: r.url, Clone: CloneNative, Cache: true, Depth: 1, CacheBudget: 10})
+	if err := m.clone(filepath.Join(t.TempDir(), "clone")); err != nil {
+		t.Fatal(err)
+	}
+	if n := cached(); n != 0 {
+		t.Fatalf("shallow clone cached %d repositories", n)
+	}
+
+	m = NewGitFSMount(util.FakeLogger{T: t}, nil, &Config{URL: r.url, Clone: CloneNative, Cache: true, Revision: "dev", CacheBudget: 10})
+	path := filepath.Join(t.TempDir(), "clone")
+	if err := m.clone(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(path, "file.txt")); err != nil || string(data) != "two" {
+		t.Fatalf("got '%s', %v, want 'two'", data, err)
+	}
+	if n := cached(); n != 1 {
+		t.Fatalf("got %d cached repositories, want 1", n)
+	}
+
+	// Nothing is mounted, so the repository is evicted once over budget.
+	evictCache(util.FakeLogger{T: t}, "", 0)
+	if n := cached(); n != 0 {
+		t.Fatalf("got %d cached repositories after eviction, want 0", n)
+	}
+}
+
+// gitServer serves bare repositories in root with git http-backend and
+// records whether requests carried credentials. With user set requests
+// without them are refused.
+type gitServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	withAuth int
+}
+
+func newGitServer(t *testing.T, root, user, password string) *gitServer {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git binary is not found")
+	}
+	backend := &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	s := &gitServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		s.mu.Lock()
+		if r.Header.Get("Authorization") != "" {
+			s.withAuth++
+		}
+		s.mu.Unlock()
+		if user != "" && (!ok || u != user || p != password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *gitServer) authRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withAuth
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// Credentials of the volume must not leak to a submodule on another host.
+func TestCloneSubmoduleOtherHost(t *testing.T) {
+	sub := newTestRepo(t)
+	other := newGitServer(t, filepath.Dir(sub.url), "", "")
+
+	src := t.TempDir()
+	runGit(t, src, "init", "-q")
+	gitmodules := "[submodule \"sub\"]\n\tpath = sub\n\turl = " + other.URL + "/repo.git\n"
+	if err := ioutil.WriteFile(filepath.Join(src, ".gitmodules"), []byte(gitmodules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, src, "add", ".gitmodules")
+	runGit(t, src, "update-index", "--add", "--cacheinfo", "160000,"+sub.commits[2].String()+",sub")
+	runGit(t, src, "commit", "-q", "-m", "submodule")
+	root := t.TempDir()
+	runGit(t, src, "clone", "-q", "--bare", src, filepath.Join(root, "main.git"))
+	main := newGitServer(t, root, "user", "secret")
+
+	for _, clone := range []string{CloneNative, CloneBinary} {
+		conf := &Config{URL: main.URL + "/main.git", Username: "user", Password: "secret", Submodules: true, Clone: clone}
+		m := NewGitFSMount(util.FakeLogger{T: t}, util.NewExec(), conf)
+		path := t.TempDir()
+		if err := m.clone(path); err != nil {
+			t.Errorf("%s: %v", clone, err)
+			continue
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(path, "sub", "file.txt")); err != nil || string(data) != "three" {
+			t.Errorf("%s: got submodule file '%s', %v", clone, data, err)
+		}
+		if main.authRequests() == 0 {
+			t.Errorf("%s: credentials were not sent to the volume host", clone)
+		}
+		if n := other.authRequests(); n != 0 {
+			t.Errorf("%s: credentials were sent to submodule host %d times", clone, n)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+const syncHelper = "gitsync"
+
+// With syncInterval every revision is checked out to its own directory
+// under worktreesDir and currentLink points to the latest one, so
+// readers never see a half-updated tree.
+const (
+	worktreesDir = ".worktrees"
+	currentLink  = "current"
+)
+
+func init() {
+	share.RegisterHelper(syncHelper, serveSync)
+}
+
+// serveSync periodically moves the clone at path to the commit
+// the revision points to on the remote, until it is terminated.
+func serveSync(slog util.Logger, input io.Reader, path string) error {
+	conf := &Config{}
+	if err := json.NewDecoder(input).Decode(conf); err != nil {
+		return fmt.Errorf("Bad sync helper input: %v", err)
+	}
+	m := NewGitFSMount(slog, util.NewExec(), conf)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(conf.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			err := m.sync(path)
+			if IsKind(err, ErrRefNotFound) && isSHA(conf.Revision) {
+				slog.Info(fmt.Sprintf("Revision '%s' is a commit, nothing to sync at '%s'", conf.Revision, path))
+				return nil
+			}
+			if err != nil {
+				slog.Warning(fmt.Sprintf("Failed sync %s at '%s': %v", conf.URL, path, err))
+			}
+		}
+	}
+}
+
+func (m *GitFSMount) startSync(path string) error {
+	input, err := json.Marshal(m.conf)
+	if err != nil {
+		return err
+	}
+	if err := share.StopHelper(syncHelper, path); err != nil {
+		m.slog.Warning(err.Error())
+	}
+	_, err = share.StartHelper(syncHelper, path, input)
+	return err
+}
+
+// sync checks out new worktree if the remote revision has moved.
+// Read-only volume is updated through its staging dir, see workRoot.
+func (m *GitFSMount) sync(path string) error {
+	commit, err := m.remoteCommit()
+	if err != nil {
+		return err
+	}
+	root := m.workRoot(path)
+	current, err := os.Readlink(filepath.Join(root, currentLink))
+	if err == nil && filepath.Base(current) == commit {
+		return nil
+	}
+	return m.checkout(root)
+}
+
+// remoteCommit returns commit the revision currently points to on the remote.
+func (m *GitFSMount) remoteCommit() (string, error) {
+	rev := m.conf.Revision
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if m.conf.Clone != CloneBinary {
+		auth, cleanup, err := m.nativeAuth()
+		defer cleanup()
+		if err != nil {
+			return "", err
+		}
+		_, hash, err := m.resolveNative(auth, rev)
+		if err == nil {
+			return hash.String(), nil
+		}
+		if m.conf.Clone == CloneNative || !IsKind(err, ErrUnknown) {
+			return "", err
+		}
+		if _, lookErr := m.exec.LookPath("git"); lookErr != nil {
+			return "", err
+		}
+	}
+	env, cleanup, err := m.authEnv()
+	defer cleanup()
+	if err != nil {
+		return "", err
+	}
+	m.env = env
+	defer func() {
+		m.env = nil
+	}()
+	return m.resolveRemote(rev)
+}
+
+// checkout clones the repository into new worktree, atomically switches
+// currentLink to it and removes previous worktrees.
+func (m *GitFSMount) checkout(path string) error {
+	worktrees := filepath.Join(path, worktreesDir)
+	if err := os.MkdirAll(worktrees, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(worktrees, "tmp-")
+	if err != nil {
+		return err
+	}
+	if err := m.clone(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	repo, err := gogit.PlainOpen(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	commit := head.Hash().String()
+	dir := filepath.Join(worktrees, commit)
+	if err := os.RemoveAll(dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	// Symlink is replaced with rename, which is atomic.
+	link := filepath.Join(path, currentLink)
+	os.Remove(link + ".tmp")
+	if err := os.Symlink(filepath.Join(worktreesDir, commit), link+".tmp"); err != nil {
+		return err
+	}
+	if err := os.Rename(link+".tmp", link); err != nil {
+		return err
+	}
+	m.slog.Info(fmt.Sprintf("Switched '%s' to %s", link, commit))
+
+	entries, err := ioutil.ReadDir(worktrees)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != commit {
+			if err := os.RemoveAll(filepath.Join(worktrees, e.Name())); err != nil {
+				m.slog.Warning(fmt.Sprintf("Failed remove old worktree: %v", err))
+			}
+		}
+	}
+	return nil
+}
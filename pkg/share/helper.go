@@ -0,0 +1,163 @@
+package share
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// HelperStateDir is a variable so tests can keep pid files in a temp dir.
+var HelperStateDir = StateDir + "/helpers"
+
+// Helper is long running part of a backend, e.g. in-process FUSE server.
+// It runs in a detached copy of the driver binary started by StartHelper,
+// reads its input from stdin and serves path until it is unmounted.
+type Helper func(slog util.Logger, input io.Reader, path string) error
+
+var (
+	helpersMu sync.RWMutex
+	helpers   = make(map[string]Helper)
+)
+
+// RegisterHelper makes helper available to RunHelper by name.
+func RegisterHelper(name string, h Helper) {
+	helpersMu.Lock()
+	defer helpersMu.Unlock()
+	if h == nil {
+		panic("share: RegisterHelper helper is nil for " + name)
+	}
+	if _, dup := helpers[name]; dup {
+		panic("share: RegisterHelper called twice for " + name)
+	}
+	helpers[name] = h
+}
+
+// RunHelper runs registered helper in current process.
+func RunHelper(slog util.Logger, name string, input io.Reader, path string) error {
+	helpersMu.RLock()
+	h, ok := helpers[name]
+	helpersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("Helper '%s' is not registered", name)
+	}
+	return h(slog, input, path)
+}
+
+func helperPidFile(name string, path string) string {
+	return filepath.Join(HelperStateDir, fmt.Sprintf("%s-%x.pid", name, sha1.Sum([]byte(path))))
+}
+
+// StartHelper starts detached helper process for path and passes input to its stdin.
+// Returned channel receives process exit result.
+func StartHelper(name string, path string, input []byte) (<-chan error, error) {
+	bin, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Failed find driver binary: %v", err)
+	}
+	if err := os.MkdirAll(HelperStateDir, 0700); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(bin, "helper", name, path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed start helper '%s': %v", name, err)
+	}
+	if _, err := stdin.Write(input); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("Failed pass input to helper '%s': %v", name, err)
+	}
+	stdin.Close()
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if err := ioutil.WriteFile(helperPidFile(name, path), []byte(pid), 0600); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	return done, nil
+}
+
+// helperProcess returns name and path of helper running as pid,
+// ok is false if pid is not a helper anymore.
+func helperProcess(pid int) (name string, path string, ok bool) {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", "", false
+	}
+	// <driver> helper <name> <path>, see StartHelper.
+	args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	if len(args) != 4 || args[1] != "helper" {
+		return "", "", false
+	}
+	return args[2], args[3], true
+}
+
+// StopHelper terminates helper process serving path if it is still alive
+// and waits until it exits. Helper is killed if it doesn't exit in time.
+func StopHelper(name string, path string) error {
+	pidFile := helperPidFile(name, path)
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(pidFile)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("Bad helper pid file '%s': %v", pidFile, err)
+	}
+	// Check pid still belongs to the helper, it could be reused.
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || !strings.Contains(string(cmdline), "helper\x00"+name+"\x00") {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("Failed stop helper '%s' pid %d: %v", name, pid, err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("Failed kill helper '%s' pid %d: %v", name, pid, err)
+	}
+	return nil
+}
+
+// StopHelpers stops all helpers serving path.
+func StopHelpers(path string) error {
+	helpersMu.RLock()
+	var names []string
+	for name := range helpers {
+		names = append(names, name)
+	}
+	helpersMu.RUnlock()
+	for _, name := range names {
+		if err := StopHelper(name, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
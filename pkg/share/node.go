@@ -0,0 +1,158 @@
+package share
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	NodeConfigFile = "/etc/kuberlab-share/config.yaml"
+	// NodeConfigName is looked up next to the driver binary before NodeConfigFile.
+	NodeConfigName = "config.yaml"
+	// AllFS section of node config applies to every FS type.
+	AllFS = "all"
+)
+
+// NodeConfig holds node defaults of share options by FS type, e.g.
+//
+//	s3:
+//	  image: registry.local/s3fs:1.86
+//	  mount_timeout: 5m
+//	download:
+//	  downloader_image: kuberlab/pluk-downloader:1.2.0
+//
+// Any option of the backend except secrets can be set, options given
+// for a volume override them. Node options, e.g. images and runtime,
+// can be set only here. Section all sets options of every FS type
+// which has them, e.g. runtime, FS type sections override it.
+type NodeConfig map[string]map[string]interface{}
+
+// FindNodeConfig returns path of node config file, it may not exist.
+func FindNodeConfig() string {
+	if bin, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(bin), NodeConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return NodeConfigFile
+}
+
+// LoadNodeConfig reads and validates node config from path.
+// Missing file is an empty config.
+func LoadNodeConfig(path string) (NodeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NodeConfig{}, nil
+		}
+		return nil, err
+	}
+	conf := NodeConfig{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("Bad node config '%s': %v", path, err)
+	}
+	if errs := conf.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("Invalid node config '%s': %s", path, strings.Join(errs, "; "))
+	}
+	return conf, nil
+}
+
+func (n NodeConfig) validate() ConfigError {
+	var names []string
+	for fs := range n {
+		names = append(names, fs)
+	}
+	sort.Strings(names)
+	var errs ConfigError
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	for _, fs := range names {
+		if fs == AllFS {
+			errs = append(errs, validateAll(n[fs])...)
+			continue
+		}
+		b, ok := backends[fs]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("FS type '%s' is not supported", fs))
+			continue
+		}
+		for _, e := range checkValues(b.config, n[fs]) {
+			errs = append(errs, fs+": "+e)
+		}
+	}
+	return errs
+}
+
+// validateAll checks options of all section with every backend having them,
+// backendsMu must be held.
+func validateAll(values map[string]interface{}) ConfigError {
+	var errs ConfigError
+	seen := make(map[string]bool)
+	known := make(map[string]bool)
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := backends[name]
+		sub := make(map[string]interface{})
+		for _, o := range b.options {
+			if v, ok := values[o.Name]; ok {
+				sub[o.Name] = v
+				known[o.Name] = true
+			}
+		}
+		for _, e := range checkValues(b.config, sub) {
+			if !seen[e] {
+				seen[e] = true
+				errs = append(errs, AllFS+": "+e)
+			}
+		}
+	}
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, fmt.Sprintf("%s: unknown option '%s'", AllFS, name))
+	}
+	return errs
+}
+
+// withDefaults returns share options c completed with node defaults of FS type fs.
+func (n NodeConfig) withDefaults(fs string, c map[string]interface{}) map[string]interface{} {
+	defaults := make(map[string]interface{}, len(n[AllFS])+len(n[fs]))
+	for k, v := range n[AllFS] {
+		defaults[k] = v
+	}
+	for k, v := range n[fs] {
+		defaults[k] = v
+	}
+	if len(defaults) == 0 {
+		return c
+	}
+	merged := make(map[string]interface{}, len(c)+len(defaults))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range c {
+		if s, ok := v.(string); ok && s == "" {
+			if _, ok := defaults[k]; ok {
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
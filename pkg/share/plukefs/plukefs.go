@@ -2,51 +2,122 @@ package plukefs
 
 import (
 	"fmt"
-	"log/syslog"
-	"os/exec"
+	"os"
+	"strings"
 	"syscall"
 	"time"
 
-	"errors"
+	"github.com/kuberlab/s3share/pkg/share"
 	"github.com/kuberlab/s3share/pkg/util"
-	"strings"
 )
 
 type PlukeFSMount struct {
-	slog *syslog.Writer
+	slog util.Logger
 	exec util.Interface
-	conf map[string]interface{}
+	rt   util.DaemonRuntime
+	conf *Config
+}
+
+type Config struct {
+	share.Access
+	share.Daemon
+	SecretWorkspace string `share:"secret_workspace,required" description:"Workspace used to authorize requests"`
+	ObjectWorkspace string `share:"object_workspace,required" description:"Workspace which owns the dataset"`
+	Name            string `share:"name,required" description:"Dataset or model name"`
+	Version         string `share:"version,required" description:"Dataset or model version"`
+	Type            string `share:"type" default:"dataset" description:"Object type"`
+	Server          string `share:"server" description:"Pluk server URL, node IP on server_port by default"`
+	Token           string `share:"token,secret" description:"Workspace secret"`
+
+	ServerPort   int           `share:"server_port" default:"30802" description:"Pluk port on the node if server is not set"`
+	Image        string        `share:"image,node" default:"kuberlab/plukefs:latest" description:"plukefs container image"`
+	MountTimeout time.Duration `share:"mount_timeout" default:"2m" description:"How long to wait for the mount to appear"`
+}
+
+const (
+	// plukefsSecretFile is where workspace secret is bind mounted into
+	// the daemon, plukefs reads it on start with -o secret_file. Neither
+	// the process list nor container inspect shows it.
+	plukefsSecretFile = "/run/plukefs/secret"
+	cleanupLock       = "plukefs-cleanup"
+	// imageLabel marks daemons for cleanup of exited ones.
+	imageLabel = "flex.mount.image"
+	// cleanupMax limits how many exited daemons one mount removes.
+	cleanupMax = 3
+)
+
+func (c *Config) Validate() error {
+	return c.Daemon.Validate()
+}
+
+func init() {
+	share.Register("plukefs", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &Config{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		rt, err := conf.NewRuntime(exec)
+		if err != nil {
+			return nil, err
+		}
+		return NewPlukeFSMount(slog, exec, rt, conf), nil
+	}, &Config{})
 }
 
-func NewPlukeFSMount(slog *syslog.Writer, conf map[string]interface{}) *PlukeFSMount {
-	return &PlukeFSMount{slog: slog, conf: conf, exec: util.NewExec()}
+func NewPlukeFSMount(slog util.Logger, exec util.Interface, rt util.DaemonRuntime, conf *Config) *PlukeFSMount {
+	return &PlukeFSMount{slog: slog, conf: conf, exec: exec, rt: rt}
+}
+
+// cleanup removes a few exited daemons of the image.
+func (m *PlukeFSMount) cleanup() {
+	ids, err := m.rt.Find(map[string]string{imageLabel: m.conf.Image})
+	if err != nil {
+		m.slog.Warning(fmt.Sprintf("Failed list plukefs containers: %v", err))
+		return
+	}
+	removed := 0
+	for _, id := range ids {
+		if removed == cleanupMax {
+			return
+		}
+		if st, err := m.rt.Inspect(id); err != nil || !st.Exited() {
+			continue
+		}
+		if err := m.rt.Remove(id); err != nil {
+			m.slog.Warning(fmt.Sprintf("Failed remove exited container %s: %v", id, err))
+			continue
+		}
+		removed++
+	}
 }
 
 func (m *PlukeFSMount) Mount(path string) error {
-	// Try to clean up Failed/Exited old containers
-	// docker ps -a -f ancestor=kuberlab/plukefs -f status=exited --format '{{ .ID }}' -n 3 | xargs -n 1 docker rm
-	cleanCmd := exec.Command("/bin/bash", "-c", "docker ps -a -f ancestor=kuberlab/plukefs -f status=exited --format '{{ .ID }}' -n 3 | xargs -n 1 docker rm")
-	_ = cleanCmd.Run()
+	// Try to clean up Failed/Exited old containers, unless another mount does it.
+	if lock, err := util.TryLock(share.LockPath(cleanupLock)); err == nil {
+		m.cleanup()
+		lock.Unlock()
+	} else if err != util.ErrLockBusy {
+		m.slog.Warning(err.Error())
+	}
 
 	start := time.Now()
 	defer func() {
 		m.slog.Info(fmt.Sprintf("Time to mount: .%3f", time.Since(start).Seconds()))
 	}()
-	cid, err := util.MountDaemon(path, m.exec)
+	ids, err := util.MountDaemon(path, m.rt)
 	if err != nil {
-		return nil
+		return err
 	}
-	if cid != "" {
+	if len(ids) > 0 {
 		if isMounted, err := util.IsMounted(path); err != nil {
 			return err
 		} else if isMounted {
 			return nil
 		} else {
-			m.slog.Warning(fmt.Sprintf("Mount point '%s' doesn't exist but container '%s' is running", path, cid))
-			if err := util.StopDaemon(cid, m.exec); err != nil {
+			m.slog.Warning(fmt.Sprintf("Mount point '%s' doesn't exist but container '%s' is running", path, strings.Join(ids, ", ")))
+			if err := util.StopMountDaemons(path, m.rt); err != nil {
 				return err
 			}
-
 		}
 	} else {
 		if isMounted, err := util.IsMounted(path); err != nil {
@@ -61,25 +132,13 @@ func (m *PlukeFSMount) Mount(path string) error {
 		}
 	}
 
-	urlRaw, ok := m.conf["server"]
-	var server string
-	if !ok {
+	server := m.conf.Server
+	if server == "" {
 		ip, err := util.LocalIP()
 		if err != nil {
 			return err
 		}
-		server = fmt.Sprintf("http://%v:30802", ip)
-	} else {
-		server = urlRaw.(string)
-	}
-
-	var secret = ""
-	if _, ok := m.conf["kubernetes.io/secret/token"]; ok {
-		token, err := util.GetSecretString(m.conf, "token")
-		if err != nil {
-			return err
-		}
-		secret = token
+		server = fmt.Sprintf("http://%v:%d", ip, m.conf.ServerPort)
 	}
 	/*
 		docker run -it --rm --mount \
@@ -89,104 +148,72 @@ func (m *PlukeFSMount) Mount(path string) error {
 		-o version=1.0.0 -o server=http://192.168.0.9:8082 -o mountPoint=/mnt/mountpoint
 	*/
 
-	args1 := []string{
-		"run",
-		"-d",
-		"--privileged",
-		"-l",
-		"flex.mount.path=" + path,
-		"--mount",
-		"type=bind,source=" + path + ",target=/mnt/mountpoint,bind-propagation=shared",
-		"--cap-add",
-		"SYS_ADMIN",
-	}
-
-	dsType, ok := m.conf["type"]
-	if !ok || dsType == "" {
-		dsType = "dataset"
-	}
-
-	// Check for required params
-	_, okSW := m.conf["secret_workspace"]
-	_, okOW := m.conf["object_workspace"]
-	_, okN := m.conf["name"]
-	_, okV := m.conf["version"]
-
-	ok = okSW && okOW && okN && okV
-	if !ok {
-		return fmt.Errorf(
-			"secret_workspace, object_workspace, name, version are required.",
-		)
+	spec := util.DaemonSpec{
+		Image:      m.conf.Image,
+		Privileged: true,
+		CapAdd:     []string{"SYS_ADMIN"},
+		Labels: map[string]string{
+			util.MountPathLabel: path,
+			imageLabel:          m.conf.Image,
+		},
+		Mounts: []util.DaemonMount{
+			{Source: path, Target: "/mnt/mountpoint", Propagation: "shared"},
+		},
+		Args: []string{
+			"plukefs",
+			//"--debug",
+			"-o",
+			fmt.Sprintf("secret_workspace=%v", m.conf.SecretWorkspace),
+			"-o",
+			fmt.Sprintf("object_workspace=%v", m.conf.ObjectWorkspace),
+			"-o",
+			fmt.Sprintf("name=%v", m.conf.Name),
+			"-o",
+			fmt.Sprintf("version=%v", m.conf.Version),
+			"-o",
+			fmt.Sprintf("type=%v", m.conf.Type),
+			"-o",
+			fmt.Sprintf("server=%v", server),
+			"-o",
+			"mountPoint=/mnt/mountpoint",
+		},
 	}
 
-	args2 := []string{
-		"kuberlab/plukefs:latest",
-		"plukefs",
-		//"--debug",
-		"-o",
-		fmt.Sprintf("secret_workspace=%v", m.conf["secret_workspace"]),
-		"-o",
-		fmt.Sprintf("object_workspace=%v", m.conf["object_workspace"]),
-		"-o",
-		fmt.Sprintf("name=%v", m.conf["name"]),
-		"-o",
-		fmt.Sprintf("version=%v", m.conf["version"]),
-		"-o",
-		fmt.Sprintf("type=%v", dsType),
-		"-o",
-		fmt.Sprintf("server=%v", server),
-		"-o",
-		fmt.Sprintf("secret=%v", secret),
-		"-o",
-		"mountPoint=/mnt/mountpoint",
+	if m.conf.Token != "" {
+		// Secret file is removed once the mount is up, daemon has read it by then.
+		secretFile, err := util.WriteSecretFile("plukefs", []byte(m.conf.Token))
+		if err != nil {
+			return fmt.Errorf("Failed write secret file: %v", err)
+		}
+		defer os.Remove(secretFile)
+		spec.Mounts = append(spec.Mounts, util.DaemonMount{Source: secretFile, Target: plukefsSecretFile, ReadOnly: true})
+		spec.Args = append(spec.Args, "-o", "secret_file="+plukefsSecretFile)
 	}
 
-	out, err := util.ExecCommand(m.exec, "docker", append(args1, args2...), "")
+	id, err := m.rt.Run(spec)
 	if err != nil {
-		return fmt.Errorf("Failed mount s3fs out='%v' error='%v'", string(out), err)
-	} else {
-		m.slog.Info(fmt.Sprintf("Start conntainer result %s", string(out)))
+		return fmt.Errorf("Failed mount plukefs: %v", err)
 	}
+	m.slog.Info(fmt.Sprintf("Start conntainer result %s", id))
 
-	cid = strings.Trim(string(out), "\n")
-
-	// Wait mount success.
-	timeout := time.NewTimer(time.Minute * 2)
-	ticker := time.NewTicker(time.Millisecond * 500)
-	mounted := false
-	for {
-		select {
-		case <-ticker.C:
-			isMounted, _ := util.IsMounted(path)
-			if isMounted {
-				mounted = true
-				break
-			}
-			if err = util.CheckDaemon(cid, m.exec); err != nil {
-				logs, err := util.DaemonLogs(cid, m.exec)
-				util.StopDaemon(cid, m.exec)
-				util.ExecCommand(m.exec, "umount", []string{"-f", path}, "")
-				if err == nil {
-					m.slog.Err(logs)
-					return errors.New(logs)
-				}
-				return errors.New("Failed mount: mount daemon has been failed")
-			}
-		case <-timeout.C:
-			m.slog.Err("Failed mount FS: timeout.")
-			util.StopDaemon(cid, m.exec)
-			util.ExecCommand(m.exec, "umount", []string{"-f", path}, "")
-			return fmt.Errorf("Failed mount: timed out")
-		}
-		if mounted {
-			break
-		}
+	if err := util.WaitMountDaemon(m.slog, m.exec, m.rt, id, path, m.conf.MountTimeout); err != nil {
+		return err
 	}
 
+	if m.conf.ReadOnly() {
+		return share.RemountReadOnly(m.exec, path)
+	}
 	return nil
 }
 
 func (m *PlukeFSMount) UnMount(path string) error {
-	// Unused ??
-	return nil
+	// Unmount first so the daemon can exit cleanly, then remove its container.
+	if isMounted, err := util.IsMounted(path); err != nil {
+		m.slog.Warning(fmt.Sprintf("Failed test mount '%s': %v", path, err))
+	} else if isMounted {
+		if err := syscall.Unmount(path, 0); err != nil {
+			return fmt.Errorf("Failed unmount '%s': %v", path, err)
+		}
+	}
+	return util.StopMountDaemons(path, m.rt)
 }
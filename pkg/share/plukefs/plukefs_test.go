@@ -0,0 +1,109 @@
+package plukefs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// specRuntime records the spec and the secret file the daemon would see,
+// then fails Run.
+type specRuntime struct {
+	*util.FakeDaemonRuntime
+	spec   util.DaemonSpec
+	secret string
+	mode   os.FileMode
+}
+
+func (r *specRuntime) Run(spec util.DaemonSpec) (string, error) {
+	r.spec = spec
+	for _, m := range spec.Mounts {
+		if m.Target != plukefsSecretFile {
+			continue
+		}
+		st, err := os.Stat(m.Source)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(m.Source)
+		if err != nil {
+			return "", err
+		}
+		r.secret, r.mode = string(data), st.Mode().Perm()
+	}
+	return "", errors.New("not started")
+}
+
+func TestMountSecretFile(t *testing.T) {
+	share.LockStateDir = t.TempDir()
+	rt := &specRuntime{FakeDaemonRuntime: util.NewFakeDaemonRuntime()}
+	conf := &Config{
+		SecretWorkspace: "ws",
+		ObjectWorkspace: "ws",
+		Name:            "ds",
+		Version:         "1.0.0",
+		Type:            "dataset",
+		Server:          "http://pluk:8082",
+		Token:           "s3cr3t-token",
+		Image:           "kuberlab/plukefs:latest",
+	}
+	m := NewPlukeFSMount(util.FakeLogger{T: t}, &util.FakeExec{}, rt, conf)
+	if err := m.Mount(t.TempDir()); err == nil || !strings.Contains(err.Error(), "not started") {
+		t.Fatalf("got %v, want run error", err)
+	}
+
+	for _, s := range append(append([]string{}, rt.spec.Env...), rt.spec.Args...) {
+		if strings.Contains(s, conf.Token) {
+			t.Errorf("secret is passed in '%s'", s)
+		}
+	}
+	if rt.secret != conf.Token || rt.mode != 0600 {
+		t.Errorf("got secret file %q mode %v", rt.secret, rt.mode)
+	}
+	var secretMount *util.DaemonMount
+	for i, dm := range rt.spec.Mounts {
+		if dm.Target == plukefsSecretFile {
+			secretMount = &rt.spec.Mounts[i]
+		}
+	}
+	if secretMount == nil || !secretMount.ReadOnly {
+		t.Fatalf("got mounts %+v", rt.spec.Mounts)
+	}
+	if _, err := os.Stat(secretMount.Source); !os.IsNotExist(err) {
+		t.Errorf("secret file %s is left: %v", secretMount.Source, err)
+	}
+	if !strings.Contains(strings.Join(rt.spec.Args, " "), "-o secret_file="+plukefsSecretFile) {
+		t.Errorf("got args %v", rt.spec.Args)
+	}
+}
+
+func TestVolumeImageRefused(t *testing.T) {
+	node := share.NodeConfig{"plukefs": {"image": "registry.local/plukefs:1.0"}}
+	c := map[string]interface{}{
+		"kuberlabFS":       "plukefs",
+		"secret_workspace": "ws",
+		"object_workspace": "ws",
+		"name":             "ds",
+		"version":          "1.0.0",
+	}
+	s, err := share.NewShareWithExec(util.FakeLogger{T: t}, &util.FakeExec{}, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := s.(*PlukeFSMount).conf.Image; image != "registry.local/plukefs:1.0" {
+		t.Errorf("got image '%s' from node config", image)
+	}
+
+	for _, name := range []string{"image", "runtime"} {
+		c[name] = "attacker/image"
+		_, err := share.NewShareWithExec(util.FakeLogger{T: t}, &util.FakeExec{}, node, c)
+		if err == nil || !strings.Contains(err.Error(), "'"+name+"' can be set only in node config") {
+			t.Errorf("volume %s: got %v, want refusal", name, err)
+		}
+		delete(c, name)
+	}
+}
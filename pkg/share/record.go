@@ -0,0 +1,176 @@
+package share
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+// RecordStateDir is a variable so tests can keep records in a temp dir.
+var RecordStateDir = StateDir + "/mounts"
+
+// Record describes mount made by the driver. It is persisted on mount
+// so unmount can rebuild the same backend and run its own teardown.
+type Record struct {
+	Path string `json:"path"`
+	Type string `json:"type,omitempty"`
+	// Conf is share options completed with node defaults, without secrets.
+	Conf map[string]interface{} `json:"conf"`
+	// Runtime and Daemons are set if the mount is served by daemon
+	// containers, they are removed even if the share can't be rebuilt.
+	Runtime string   `json:"runtime,omitempty"`
+	Daemons []string `json:"daemons,omitempty"`
+}
+
+func recordFile(path string) string {
+	return filepath.Join(RecordStateDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(path))))
+}
+
+// NewRecord describes mount of share c at path as it is resolved on the node:
+// options are completed with node defaults, daemons serving the mount are
+// looked up in the runtime the share uses. Secrets are not recorded.
+func NewRecord(slog util.Logger, exec util.Interface, node NodeConfig, c map[string]interface{}, path string) *Record {
+	fs, _ := c["kuberlabFS"].(string)
+	r := &Record{Path: path, Type: fs, Conf: make(map[string]interface{})}
+	for k, v := range node.withDefaults(fs, c) {
+		if strings.HasPrefix(k, "kubernetes.io/secret/") {
+			continue
+		}
+		r.Conf[k] = v
+	}
+	if !usesDaemon(fs) {
+		return r
+	}
+	d := &Daemon{}
+	if err := DecodeConfig(r.Conf, d); err != nil {
+		slog.Warning(fmt.Sprintf("Failed record runtime of '%s': %v", path, err))
+		return r
+	}
+	r.Runtime = d.Runtime
+	rt, err := d.NewRuntime(exec)
+	if err != nil {
+		return r
+	}
+	if r.Daemons, err = util.MountDaemon(path, rt); err != nil {
+		slog.Warning(fmt.Sprintf("Failed record daemons of '%s': %v", path, err))
+	}
+	return r
+}
+
+// SaveRecord persists record of the mount.
+func SaveRecord(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(RecordStateDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(recordFile(r.Path), data, 0600)
+}
+
+// LoadRecord returns record of the mount at path or nil if the mount wasn't recorded.
+func LoadRecord(path string) (*Record, error) {
+	data, err := ioutil.ReadFile(recordFile(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("Bad mount record for '%s': %v", path, err)
+	}
+	return &r, nil
+}
+
+func RemoveRecord(path string) error {
+	err := os.Remove(recordFile(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Mount mounts share described by c to path and records it for UnMount.
+func Mount(slog util.Logger, exec util.Interface, node NodeConfig, c map[string]interface{}, path string) error {
+	s, err := NewShareWithExec(slog, exec, node, c)
+	if err != nil {
+		return err
+	}
+	return MountShare(slog, exec, node, s, c, path)
+}
+
+// MountShare mounts already built share s and records c for UnMount.
+func MountShare(slog util.Logger, exec util.Interface, node NodeConfig, s Share, c map[string]interface{}, path string) error {
+	// Daemon of a stale mount is gone, backend restarts it once the path is free.
+	if _, err := util.DetachStaleMount(slog, path); err != nil {
+		return err
+	}
+	if err := s.Mount(path); err != nil {
+		return err
+	}
+	if err := SaveRecord(NewRecord(slog, exec, node, c, path)); err != nil {
+		slog.Warning(fmt.Sprintf("Failed save mount record for '%s': %v", path, err))
+	}
+	return nil
+}
+
+// UnMount tears down mount at path with the backend it was mounted by.
+// If the backend can't be rebuilt from the record, e.g. its validation
+// needs secrets which are not recorded, or the mount was made before
+// records existed, the mount is cleaned up by removing recorded daemons,
+// daemons labeled with the path and helpers and unmounting the path.
+func UnMount(slog util.Logger, exec util.Interface, node NodeConfig, path string) error {
+	if _, err := util.DetachStaleMount(slog, path); err != nil {
+		slog.Warning(err.Error())
+	}
+	r, err := LoadRecord(path)
+	if err != nil {
+		slog.Warning(err.Error())
+	}
+	if r != nil {
+		s, err := newShare(slog, exec, node, r.Conf, true)
+		if err == nil {
+			if err := s.UnMount(path); err != nil {
+				return err
+			}
+			return RemoveRecord(path)
+		}
+		slog.Warning(fmt.Sprintf("Failed restore share for '%s': %v", path, err))
+		if err := RemoveRecord(path); err != nil {
+			slog.Warning(err.Error())
+		}
+	}
+	rt := nodeRuntime(slog, exec, node)
+	if r != nil && r.Runtime != "" {
+		if recorded, err := util.NewDaemonRuntime(r.Runtime, exec); err == nil {
+			rt = recorded
+		}
+		for _, id := range r.Daemons {
+			if err := rt.Remove(id); err != nil && err != util.ErrDaemonNotFound {
+				slog.Warning(fmt.Sprintf("Failed remove daemon container %v: %v", id, err))
+			}
+		}
+	}
+	if err := util.StopMountDaemons(path, rt); err != nil {
+		slog.Warning(err.Error())
+	}
+	if err := StopHelpers(path); err != nil {
+		slog.Warning(err.Error())
+	}
+	if isMounted, err := util.IsMounted(path); err != nil {
+		return fmt.Errorf("Failed test mount %v", err)
+	} else if !isMounted {
+		return nil
+	}
+	return syscall.Unmount(path, 0)
+}
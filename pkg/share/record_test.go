@@ -0,0 +1,112 @@
+package share
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+type recordTestConfig struct {
+	Access
+	Daemon
+	Bucket string `share:"bucket,required"`
+	Region string `share:"region"`
+	Key    string `share:"key,secret"`
+}
+
+// Validate needs the secret, so the share can't be rebuilt from its record.
+func (c *recordTestConfig) Validate() error {
+	if c.Key == "" {
+		return errors.New("'key' is required")
+	}
+	return c.Daemon.Validate()
+}
+
+type recordTestShare struct{}
+
+func (recordTestShare) Mount(path string) error {
+	return nil
+}
+
+func (recordTestShare) UnMount(path string) error {
+	return errors.New("share must not be rebuilt")
+}
+
+func init() {
+	Register("recordtest", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (Share, error) {
+		conf := &recordTestConfig{}
+		if err := DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		return recordTestShare{}, nil
+	}, &recordTestConfig{})
+}
+
+func TestRecordUnMountWithoutSecrets(t *testing.T) {
+	RecordStateDir = t.TempDir()
+	path := filepath.Join(t.TempDir(), "mnt")
+	slog := util.FakeLogger{T: t}
+	node := NodeConfig{
+		AllFS:        {"runtime": "podman"},
+		"recordtest": {"region": "eu"},
+	}
+	c := map[string]interface{}{
+		"kuberlabFS":               "recordtest",
+		"bucket":                   "data",
+		"kubernetes.io/secret/key": "c2VjcmV0",
+		"kubernetes.io/readwrite":  "ro",
+	}
+	log := &util.FakeCommandLog{}
+	exec := &util.FakeExec{CommandScript: []util.FakeCommandAction{
+		// Daemons serving the mount are recorded.
+		log.Action("daemon1\n", nil),
+	}}
+	s, err := NewShareWithExec(slog, exec, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MountShare(slog, exec, node, s, c, path); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := LoadRecord(path)
+	if err != nil || r == nil {
+		t.Fatalf("record is not saved: %v", err)
+	}
+	want := &Record{
+		Path: path,
+		Type: "recordtest",
+		Conf: map[string]interface{}{
+			"kuberlabFS":              "recordtest",
+			"bucket":                  "data",
+			"region":                  "eu",
+			"runtime":                 "podman",
+			"kubernetes.io/readwrite": "ro",
+		},
+		Runtime: "podman",
+		Daemons: []string{"daemon1"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got record %+v, want %+v", r, want)
+	}
+
+	// Node defaults changed since mount, recorded runtime is still used.
+	exec.CommandScript = append(exec.CommandScript, log.Action("", nil), log.Action("", nil))
+	if err := UnMount(slog, exec, NodeConfig{}, path); err != nil {
+		t.Fatal(err)
+	}
+	wantCmds := [][]string{
+		{"podman", "ps", "-a", "-q", "--no-trunc", "--filter", "label=flex.mount.path=" + path},
+		{"podman", "rm", "--force", "daemon1"},
+		{"podman", "ps", "-a", "-q", "--no-trunc", "--filter", "label=flex.mount.path=" + path},
+	}
+	if !reflect.DeepEqual(log.Cmds, wantCmds) {
+		t.Errorf("got commands %v, want %v", log.Cmds, wantCmds)
+	}
+	if r, _ := LoadRecord(path); r != nil {
+		t.Errorf("record is not removed")
+	}
+}
@@ -0,0 +1,57 @@
+package s3share
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Temporary credentials are refreshed this long before they expire.
+const credentialsExpiryWindow = 5 * time.Minute
+
+// tokenFile re-reads projected token on every refresh since kubelet rotates it.
+type tokenFile string
+
+func (t tokenFile) FetchToken(ctx credentials.Context) ([]byte, error) {
+	return ioutil.ReadFile(string(t))
+}
+
+// newCredentials returns static or anonymous credentials, or temporary
+// credentials from STS if role_arn is set. Temporary credentials are
+// refreshed by the SDK when they are about to expire.
+func newCredentials(conf *Config) (*credentials.Credentials, error) {
+	base := credentials.AnonymousCredentials
+	if conf.AccessKeyID != "" {
+		base = credentials.NewStaticCredentials(conf.AccessKeyID, conf.AccessKey, "")
+	}
+	if conf.RoleARN == "" {
+		return base, nil
+	}
+	stsSession, err := session.NewSession(&aws.Config{
+		Region:      aws.String(conf.Region),
+		Credentials: base,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conf.WebIdentityTokenFile != "" {
+		p := stscreds.NewWebIdentityRoleProviderWithOptions(
+			sts.New(stsSession), conf.RoleARN, conf.RoleSessionName, tokenFile(conf.WebIdentityTokenFile),
+			func(p *stscreds.WebIdentityRoleProvider) {
+				p.Duration = conf.RoleDuration
+				p.ExpiryWindow = credentialsExpiryWindow
+			},
+		)
+		return credentials.NewCredentials(p), nil
+	}
+	return stscreds.NewCredentials(stsSession, conf.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = conf.RoleSessionName
+		p.Duration = conf.RoleDuration
+		p.ExpiryWindow = credentialsExpiryWindow
+	}), nil
+}
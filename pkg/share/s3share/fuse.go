@@ -0,0 +1,505 @@
+package s3share
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kuberlab/s3share/pkg/share"
+	"github.com/kuberlab/s3share/pkg/util"
+)
+
+const fuseHelper = "s3fuse"
+
+func init() {
+	share.RegisterHelper(fuseHelper, serveFuse)
+}
+
+// objectStore is the part of S3 API used by the native filesystem.
+type objectStore interface {
+	ListObjectsPages(*s3.ListObjectsInput, func(*s3.ListObjectsOutput, bool) bool) error
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
+// mountNative starts detached helper serving the bucket through FUSE
+// and waits until the mount appears.
+func (m *S3FSMount) mountNative(path string) error {
+	if isMounted, err := util.IsMounted(path); err != nil {
+		return err
+	} else if isMounted {
+		return nil
+	}
+	sess, err := newSession(m.conf)
+	if err != nil {
+		return err
+	}
+	if err := m.checkBucket(s3.New(sess)); err != nil {
+		return err
+	}
+	input, err := json.Marshal(m.conf)
+	if err != nil {
+		return err
+	}
+	if err := share.StopHelper(fuseHelper, path); err != nil {
+		m.slog.Warning(err.Error())
+	}
+	done, err := share.StartHelper(fuseHelper, path, input)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(m.conf.MountTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if isMounted, _ := util.IsMounted(path); isMounted {
+				return nil
+			}
+		case err := <-done:
+			return fmt.Errorf("Failed mount: FUSE helper exited: %v", err)
+		case <-timeout.C:
+			m.slog.Err("Failed mount FS: timeout.")
+			share.StopHelper(fuseHelper, path)
+			return fmt.Errorf("Failed mount: timed out")
+		}
+	}
+}
+
+// serveFuse mounts bucket to path and serves it until path is unmounted
+// or the helper is terminated.
+func serveFuse(slog util.Logger, input io.Reader, path string) error {
+	conf := &Config{}
+	if err := json.NewDecoder(input).Decode(conf); err != nil {
+		return fmt.Errorf("Failed decode config: %v", err)
+	}
+	sess, err := newSession(conf)
+	if err != nil {
+		return err
+	}
+	options := []fuse.MountOption{
+		fuse.FSName("s3:" + conf.Bucket),
+		fuse.Subtype("kuberlab-s3"),
+		fuse.AllowOther(),
+	}
+	if conf.ReadOnly() {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(path, options...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sig
+		slog.Info(fmt.Sprintf("Stopping S3 FUSE server for '%s'", path))
+		if err := fuse.Unmount(path); err != nil {
+			syscall.Unmount(path, syscall.MNT_DETACH)
+		}
+	}()
+
+	bfs := &bucketFS{
+		store:    s3.New(sess),
+		bucket:   conf.Bucket,
+		prefix:   conf.keyPrefix(),
+		writable: !conf.ReadOnly(),
+	}
+	slog.Info(fmt.Sprintf("Serving bucket '%s' prefix '%s' at '%s'", conf.Bucket, conf.Prefix, path))
+	if err := fs.Serve(c, bfs); err != nil {
+		return err
+	}
+	<-c.Ready
+	return c.MountError
+}
+
+// bucketFS maps S3 keys under prefix to a directory tree using '/' as separator.
+type bucketFS struct {
+	store    objectStore
+	bucket   string
+	prefix   string
+	writable bool
+}
+
+func (f *bucketFS) Root() (fs.Node, error) {
+	return &dir{fs: f, key: f.prefix}, nil
+}
+
+func (f *bucketFS) mode(m os.FileMode) os.FileMode {
+	if f.writable {
+		return m
+	}
+	return m &^ 0222
+}
+
+func (f *bucketFS) list(prefix string, fn func(*s3.ListObjectsOutput) bool) error {
+	return f.store.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:    aws.String(f.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(out *s3.ListObjectsOutput, last bool) bool {
+		return fn(out)
+	})
+}
+
+// dir is a key prefix ending with '/', root of the whole bucket has empty key.
+type dir struct {
+	fs  *bucketFS
+	key string
+}
+
+var (
+	_ fs.NodeStringLookuper = (*dir)(nil)
+	_ fs.HandleReadDirAller = (*dir)(nil)
+	_ fs.NodeCreater        = (*dir)(nil)
+	_ fs.NodeMkdirer        = (*dir)(nil)
+	_ fs.NodeRemover        = (*dir)(nil)
+)
+
+func (d *dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | d.fs.mode(0777)
+	return nil
+}
+
+func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key := d.key + name
+	head, err := d.fs.store.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.fs.bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return &file{
+			fs:    d.fs,
+			key:   key,
+			size:  aws.Int64Value(head.ContentLength),
+			mtime: timeValue(head.LastModified),
+		}, nil
+	}
+	found := false
+	err = d.fs.list(key+"/", func(out *s3.ListObjectsOutput) bool {
+		found = len(out.Contents) > 0 || len(out.CommonPrefixes) > 0
+		return false
+	})
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	if !found {
+		return nil, fuse.ENOENT
+	}
+	return &dir{fs: d.fs, key: key + "/"}, nil
+}
+
+func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	err := d.fs.list(d.key, func(out *s3.ListObjectsOutput) bool {
+		for _, p := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), d.key), "/")
+			if name != "" {
+				entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+			}
+		}
+		for _, o := range out.Contents {
+			name := strings.TrimPrefix(aws.StringValue(o.Key), d.key)
+			// Skip directory marker objects.
+			if name != "" && !strings.HasSuffix(name, "/") {
+				entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return entries, nil
+}
+
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if !d.fs.writable {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	key := d.key + req.Name + "/"
+	_, err := d.fs.store.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(d.fs.bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(""),
+	})
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return &dir{fs: d.fs, key: key}, nil
+}
+
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if !d.fs.writable {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+	f := &file{fs: d.fs, key: d.key + req.Name, mtime: time.Now()}
+	tmp, err := ioutil.TempFile("", "s3fuse")
+	if err != nil {
+		return nil, nil, fuse.Errno(syscall.EIO)
+	}
+	// Create the object right away so it is visible to Lookup.
+	h := &fileHandle{file: f, tmp: tmp, dirty: true}
+	if err := h.upload(); err != nil {
+		h.close()
+		return nil, nil, err
+	}
+	return f, h, nil
+}
+
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !d.fs.writable {
+		return fuse.Errno(syscall.EROFS)
+	}
+	key := d.key + req.Name
+	if req.Dir {
+		empty := true
+		err := d.fs.list(key+"/", func(out *s3.ListObjectsOutput) bool {
+			for _, o := range out.Contents {
+				if aws.StringValue(o.Key) != key+"/" {
+					empty = false
+				}
+			}
+			if len(out.CommonPrefixes) > 0 {
+				empty = false
+			}
+			return empty
+		})
+		if err != nil {
+			return fuse.Errno(syscall.EIO)
+		}
+		if !empty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		key += "/"
+	}
+	_, err := d.fs.store.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.fs.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+type file struct {
+	fs    *bucketFS
+	key   string
+	mu    sync.Mutex
+	size  int64
+	mtime time.Time
+}
+
+var (
+	_ fs.NodeOpener    = (*file)(nil)
+	_ fs.NodeSetattrer = (*file)(nil)
+)
+
+func (f *file) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a.Mode = f.fs.mode(0666)
+	a.Size = uint64(f.size)
+	a.Mtime = f.mtime
+	return nil
+}
+
+func (f *file) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() {
+		return &fileHandle{file: f}, nil
+	}
+	if !f.fs.writable {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	// Writes go to a local copy which is uploaded on flush.
+	tmp, err := ioutil.TempFile("", "s3fuse")
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	h := &fileHandle{file: f, tmp: tmp}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		h.dirty = true
+		return h, nil
+	}
+	obj, err := f.fs.store.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.fs.bucket),
+		Key:    aws.String(f.key),
+	})
+	if err != nil {
+		h.close()
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	defer obj.Body.Close()
+	if _, err := io.Copy(tmp, obj.Body); err != nil {
+		h.close()
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return h, nil
+}
+
+func (f *file) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if !f.fs.writable {
+			return fuse.Errno(syscall.EROFS)
+		}
+		// Only truncation used by O_TRUNC is supported.
+		if req.Size != 0 {
+			return fuse.Errno(syscall.ENOTSUP)
+		}
+		_, err := f.fs.store.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(f.fs.bucket),
+			Key:    aws.String(f.key),
+			Body:   strings.NewReader(""),
+		})
+		if err != nil {
+			return fuse.Errno(syscall.EIO)
+		}
+		f.mu.Lock()
+		f.size = 0
+		f.mtime = time.Now()
+		f.mu.Unlock()
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+type fileHandle struct {
+	file  *file
+	mu    sync.Mutex
+	tmp   *os.File
+	dirty bool
+}
+
+var (
+	_ fs.HandleReader   = (*fileHandle)(nil)
+	_ fs.HandleWriter   = (*fileHandle)(nil)
+	_ fs.HandleFlusher  = (*fileHandle)(nil)
+	_ fs.HandleReleaser = (*fileHandle)(nil)
+)
+
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tmp != nil {
+		buf := make([]byte, req.Size)
+		n, err := h.tmp.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			return fuse.Errno(syscall.EIO)
+		}
+		resp.Data = buf[:n]
+		return nil
+	}
+	h.file.mu.Lock()
+	size := h.file.size
+	h.file.mu.Unlock()
+	if req.Offset >= size || req.Size == 0 {
+		return nil
+	}
+	obj, err := h.file.fs.store.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(h.file.fs.bucket),
+		Key:    aws.String(h.file.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", req.Offset, req.Offset+int64(req.Size)-1)),
+	})
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	defer obj.Body.Close()
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(obj.Body, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fuse.Errno(syscall.EIO)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tmp == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	n, err := h.tmp.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	h.dirty = true
+	resp.Size = n
+	return nil
+}
+
+func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.upload()
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.upload()
+	h.close()
+	return err
+}
+
+// upload puts local copy to the bucket if it was changed.
+func (h *fileHandle) upload() error {
+	if h.tmp == nil || !h.dirty {
+		return nil
+	}
+	if _, err := h.tmp.Seek(0, io.SeekStart); err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	_, err := h.file.fs.store.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(h.file.fs.bucket),
+		Key:    aws.String(h.file.key),
+		Body:   h.tmp,
+	})
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	st, err := h.tmp.Stat()
+	if err != nil {
+		return fuse.Errno(syscall.EIO)
+	}
+	h.file.mu.Lock()
+	h.file.size = st.Size()
+	h.file.mtime = time.Now()
+	h.file.mu.Unlock()
+	h.dirty = false
+	return nil
+}
+
+func (h *fileHandle) close() {
+	if h.tmp != nil {
+		h.tmp.Close()
+		os.Remove(h.tmp.Name())
+		h.tmp = nil
+	}
+}
+
+func timeValue(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,302 @@
+package s3share
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 serves objects of a single bucket with path style requests,
+// enough of ListObjects, HeadObject, GetObject, PutObject and DeleteObject
+// for bucketFS.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]string
+	// requests are "METHOD key" of object requests, ranges are appended.
+	requests []string
+}
+
+type listResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	IsTruncated    bool
+	Contents       []listObject
+	CommonPrefixes []listPrefix
+}
+
+type listObject struct {
+	Key  string
+	Size int
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == f.bucket && r.Method == "GET" {
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+	if !strings.HasPrefix(path, f.bucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(path, f.bucket+"/")
+	req := r.Method + " " + key
+	if rng := r.Header.Get("Range"); rng != "" {
+		req += " " + rng
+	}
+	f.requests = append(f.requests, req)
+	switch r.Method {
+	case "HEAD", "GET":
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Unix(1500000000, 0), strings.NewReader(data))
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.objects[key] = string(data)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	res := listResult{Name: f.bucket, Prefix: prefix, Delimiter: delimiter}
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: p})
+			}
+			continue
+		}
+		res.Contents = append(res.Contents, listObject{Key: k, Size: len(f.objects[k])})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) objectRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func newTestFS(t *testing.T, writable bool) (*bucketFS, *fakeS3) {
+	fake := &fakeS3{bucket: "bucket", objects: map[string]string{
+		"data/a.txt":       "hello world",
+		"data/sub/":        "",
+		"data/sub/b.txt":   "b",
+		"data/sub/c/d.txt": "d",
+		"other.txt":        "other",
+	}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	sess, err := newSession(&Config{Server: srv.URL, Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bucketFS{
+		store:    s3.New(sess),
+		bucket:   "bucket",
+		prefix:   "data/",
+		writable: writable,
+	}, fake
+}
+
+func rootDir(t *testing.T, bfs *bucketFS) *dir {
+	root, err := bfs.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root.(*dir)
+}
+
+func TestBucketFSReadDir(t *testing.T) {
+	bfs, _ := newTestFS(t, true)
+	ctx := context.Background()
+	root := rootDir(t, bfs)
+
+	entries, err := root.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fuse.Dirent{
+		{Name: "sub", Type: fuse.DT_Dir},
+		{Name: "a.txt", Type: fuse.DT_File},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got root entries %v, want %v", entries, want)
+	}
+
+	node, err := root.Lookup(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, ok := node.(*dir)
+	if !ok || sub.key != "data/sub/" {
+		t.Fatalf("got %#v, want dir data/sub/", node)
+	}
+	entries, err = sub.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Directory marker data/sub/ is not listed.
+	want = []fuse.Dirent{
+		{Name: "c", Type: fuse.DT_Dir},
+		{Name: "b.txt", Type: fuse.DT_File},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got sub entries %v, want %v", entries, want)
+	}
+
+	if _, err := root.Lookup(ctx, "missing"); err != fuse.ENOENT {
+		t.Errorf("lookup of missing name: got %v, want ENOENT", err)
+	}
+	// Objects outside of the prefix are not visible.
+	if _, err := root.Lookup(ctx, "other.txt"); err != fuse.ENOENT {
+		t.Errorf("lookup outside of prefix: got %v, want ENOENT", err)
+	}
+}
+
+func TestBucketFSRangeRead(t *testing.T) {
+	bfs, fake := newTestFS(t, false)
+	ctx := context.Background()
+
+	node, err := rootDir(t, bfs).Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := node.(*file)
+	if !ok {
+		t.Fatalf("got %#v, want file", node)
+	}
+	var attr fuse.Attr
+	if err := f.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size != 11 {
+		t.Errorf("got size %d, want 11", attr.Size)
+	}
+
+	h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		offset int64
+		size   int
+		want   string
+	}{
+		{0, 5, "hello"},
+		{6, 100, "world"},
+		// Reads past the end don't reach the bucket.
+		{11, 10, ""},
+	}
+	for _, c := range cases {
+		resp := &fuse.ReadResponse{}
+		if err := h.(*fileHandle).Read(ctx, &fuse.ReadRequest{Offset: c.offset, Size: c.size}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Data) != c.want {
+			t.Errorf("read %d+%d: got '%s', want '%s'", c.offset, c.size, resp.Data, c.want)
+		}
+	}
+
+	want := []string{
+		"HEAD data/a.txt",
+		"GET data/a.txt bytes=0-4",
+		"GET data/a.txt bytes=6-105",
+	}
+	if got := fake.objectRequests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestBucketFSReadOnly(t *testing.T) {
+	bfs, fake := newTestFS(t, false)
+	ctx := context.Background()
+	root := rootDir(t, bfs)
+	erofs := fuse.Errno(syscall.EROFS)
+
+	var attr fuse.Attr
+	if err := root.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Mode&0222 != 0 {
+		t.Errorf("dir mode %v is writable", attr.Mode)
+	}
+	node, err := root.Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := node.(*file)
+	if err := f.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Mode&0222 != 0 {
+		t.Errorf("file mode %v is writable", attr.Mode)
+	}
+
+	if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "new"}); err != erofs {
+		t.Errorf("mkdir: got %v, want EROFS", err)
+	}
+	if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "new.txt"}, &fuse.CreateResponse{}); err != erofs {
+		t.Errorf("create: got %v, want EROFS", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "a.txt"}); err != erofs {
+		t.Errorf("remove: got %v, want EROFS", err)
+	}
+	if _, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{}); err != erofs {
+		t.Errorf("open for write: got %v, want EROFS", err)
+	}
+	if err := f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{}); err != erofs {
+		t.Errorf("truncate: got %v, want EROFS", err)
+	}
+
+	for _, r := range fake.objectRequests() {
+		if !strings.HasPrefix(r, "HEAD ") && !strings.HasPrefix(r, "GET ") {
+			t.Errorf("read-only FS sent '%s'", r)
+		}
+	}
+}
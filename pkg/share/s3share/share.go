@@ -2,25 +2,149 @@ package s3share
 
 import (
 	"fmt"
-	"log/syslog"
+	"os"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kuberlab/s3share/pkg/share"
 	"github.com/kuberlab/s3share/pkg/util"
 )
 
 type S3FSMount struct {
-	slog *syslog.Writer
+	slog util.Logger
 	exec util.Interface
-	conf map[string]interface{}
+	rt   util.DaemonRuntime
+	conf *Config
 }
 
-func NewS3FSMount(slog *syslog.Writer, conf map[string]interface{}) *S3FSMount {
-	return &S3FSMount{slog: slog, conf: conf, exec: util.NewExec()}
+type Config struct {
+	share.Access
+	share.Daemon
+	Bucket      string `share:"bucket,required" description:"Bucket name"`
+	Prefix      string `share:"prefix" description:"Mount only objects under this path in the bucket"`
+	Server      string `share:"server" description:"S3 endpoint URL"`
+	Region      string `share:"region" default:"us-east-1" description:"Bucket region"`
+	AccessKeyID string `share:"aws_access_key_id,secret" description:"Access key ID, anonymous access if not set"`
+	AccessKey   string `share:"aws_access_key,secret" description:"Secret access key"`
+	Driver      string `share:"mode" default:"s3fs" description:"Mount with s3fs container (s3fs) or in-process FUSE helper (native)"`
+
+	Image        string        `share:"image,node" default:"kuberlab/s3fs" description:"s3fs container image"`
+	MultireqMax  int           `share:"multireq_max" default:"5" description:"Parallel requests of s3fs"`
+	MountTimeout time.Duration `share:"mount_timeout" default:"2m" description:"How long to wait for the mount to appear"`
+
+	RoleARN              string        `share:"role_arn" description:"Role to assume, temporary credentials need native mode"`
+	RoleSessionName      string        `share:"role_session_name" default:"kuberlab-share" description:"Session name of the assumed role"`
+	RoleDuration         time.Duration `share:"role_duration" default:"1h" description:"Lifetime of temporary credentials"`
+	WebIdentityTokenFile string        `share:"web_identity_token_file" description:"Node path of projected OIDC token to assume role with web identity, read on every refresh"`
+}
+
+const (
+	ModeS3FS   = "s3fs"
+	ModeNative = "native"
+
+	s3fsPasswdFile = "/run/s3share/passwd-s3fs"
+)
+
+func (c *Config) Validate() error {
+	var errs share.ConfigError
+	if c.AccessKeyID != "" && c.AccessKey == "" {
+		errs = append(errs, "'aws_access_key' is required with 'aws_access_key_id'")
+	}
+	if strings.Contains(strings.Trim(c.Prefix, "/"), "//") {
+		errs = append(errs, fmt.Sprintf("'prefix' has empty path element: '%s'", c.Prefix))
+	}
+	if c.MultireqMax < 1 {
+		errs = append(errs, "'multireq_max' must be positive")
+	}
+	if c.MountTimeout <= 0 {
+		errs = append(errs, "'mount_timeout' must be positive")
+	}
+	if err := c.Daemon.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.Driver != ModeS3FS && c.Driver != ModeNative {
+		errs = append(errs, fmt.Sprintf("'mode' must be %s or %s", ModeS3FS, ModeNative))
+	}
+	if c.WebIdentityTokenFile != "" && c.RoleARN == "" {
+		errs = append(errs, "'role_arn' is required for web identity")
+	}
+	if c.RoleARN != "" && c.WebIdentityTokenFile == "" && c.AccessKeyID == "" {
+		errs = append(errs, "'role_arn' needs 'aws_access_key_id' or 'web_identity_token_file'")
+	}
+	if c.RoleARN != "" && c.Driver != ModeNative {
+		// s3fs reads passwd file only on start and has no way to get
+		// new keys of assumed role, the mount would fail once they expire.
+		errs = append(errs, fmt.Sprintf("'role_arn' is supported only in '%s' mode", ModeNative))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func newSession(conf *Config) (*session.Session, error) {
+	config := &aws.Config{
+		Region:                        aws.String(conf.Region),
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+	if conf.Server != "" {
+		config.Endpoint = aws.String(conf.Server)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	creds, err := newCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+	config.Credentials = creds
+	return session.NewSession(config)
+}
+
+// keyPrefix returns key prefix of the mounted subtree, empty for whole bucket.
+func (c *Config) keyPrefix() string {
+	p := strings.Trim(c.Prefix, "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// checkBucket makes sure the bucket and prefix are reachable before anything is mounted.
+func (m *S3FSMount) checkBucket(s3s *s3.S3) error {
+	out, err := s3s.ListObjects(&s3.ListObjectsInput{
+		Bucket:  aws.String(m.conf.Bucket),
+		Prefix:  aws.String(m.conf.keyPrefix()),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		m.slog.Warning(fmt.Sprintf("Get bucket location error %v", err))
+		return fmt.Errorf("Bucket request failed: %v", err)
+	}
+	if m.conf.keyPrefix() != "" && len(out.Contents) == 0 && len(out.CommonPrefixes) == 0 {
+		return fmt.Errorf("Prefix '%s' is empty or doesn't exist in bucket '%s'", m.conf.Prefix, m.conf.Bucket)
+	}
+	return nil
+}
+
+func init() {
+	share.Register("s3", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &Config{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		rt, err := conf.NewRuntime(exec)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3FSMount(slog, exec, rt, conf), nil
+	}, &Config{})
+}
+
+func NewS3FSMount(slog util.Logger, exec util.Interface, rt util.DaemonRuntime, conf *Config) *S3FSMount {
+	return &S3FSMount{slog: slog, conf: conf, exec: exec, rt: rt}
 }
 
 func (m *S3FSMount) Mount(path string) error {
@@ -28,21 +152,23 @@ func (m *S3FSMount) Mount(path string) error {
 	defer func() {
 		m.slog.Info(fmt.Sprintf("Time to mount: .%3f", time.Since(start).Seconds()))
 	}()
-	cid, err := util.MountDaemon(path, m.exec)
+	if m.conf.Driver == ModeNative {
+		return m.mountNative(path)
+	}
+	ids, err := util.MountDaemon(path, m.rt)
 	if err != nil {
-		return nil
+		return err
 	}
-	if cid != "" {
+	if len(ids) > 0 {
 		if isMounted, err := util.IsMounted(path); err != nil {
 			return err
 		} else if isMounted {
 			return nil
 		} else {
-			m.slog.Warning(fmt.Sprintf("Mount point '%s' doesn't exist but container '%s' is running", path, cid))
-			if err := util.StopDaemon(cid, m.exec); err != nil {
+			m.slog.Warning(fmt.Sprintf("Mount point '%s' doesn't exist but container '%s' is running", path, strings.Join(ids, ", ")))
+			if err := util.StopMountDaemons(path, m.rt); err != nil {
 				return err
 			}
-
 		}
 	} else {
 		if isMounted, err := util.IsMounted(path); err != nil {
@@ -56,140 +182,87 @@ func (m *S3FSMount) Mount(path string) error {
 			}
 		}
 	}
-	bucketRaw, ok := m.conf["bucket"]
-	var bucket string
-	if ok {
-		bucket = bucketRaw.(string)
-	} else {
-		return fmt.Errorf("'bucket' required in config")
+	bucket := m.conf.Bucket
+	if p := m.conf.keyPrefix(); p != "" {
+		// s3fs mounts sub-path with bucket:/path syntax.
+		bucket = fmt.Sprintf("%s:/%s", bucket, strings.TrimSuffix(p, "/"))
 	}
 
-	var server *string = nil
-	var region *string = nil
-	serverRaw, ok := m.conf["server"]
-	if ok {
-		server = aws.String(serverRaw.(string))
+	spec := util.DaemonSpec{
+		Image:      m.conf.Image,
+		Privileged: true,
+		CapAdd:     []string{"SYS_ADMIN"},
+		Labels:     map[string]string{util.MountPathLabel: path},
+		Mounts: []util.DaemonMount{
+			{Source: path, Target: "/mnt/mountpoint", Propagation: "shared"},
+		},
+		// Image builds /etc/passwd-s3fs from these, keys are passed separately.
+		Env: []string{"S3User=''", "S3Secret=''"},
+		Args: []string{
+			bucket,
+			"/mnt/mountpoint",
+			"-o",
+			fmt.Sprintf("multireq_max=%d", m.conf.MultireqMax),
+			"-f",
+		},
 	}
-	regionRaw, ok := m.conf["region"]
-	if ok {
-		region = aws.String(regionRaw.(string))
-	} else {
-		region = aws.String("us-east-1")
-	}
-	if *region == "" {
-		region = aws.String("us-east-1")
-	}
-
-	args1 := []string{
-		"run",
-		"-d",
-		"--privileged",
-		"-l",
-		"flex.mount.path=" + path,
-		"--mount",
-		"type=bind,source=" + path + ",target=/mnt/mountpoint,bind-propagation=shared",
-		"--cap-add",
-		"SYS_ADMIN",
-	}
-	args2 := []string{
-		"kuberlab/s3fs",
-		bucket,
-		"/mnt/mountpoint",
-		"-o",
-		"passwd_file=/etc/passwd-s3fs",
-		"-o",
-		"multireq_max=5",
-		"-f",
-	}
-
-	if server != nil {
-		args2 = append(
-			args2,
+	if m.conf.ReadOnly() {
+		spec.Args = append(spec.Args, "-o", "ro")
+	}
+
+	if m.conf.Server != "" {
+		spec.Args = append(
+			spec.Args,
 			"-o",
-			fmt.Sprintf("url=%v", *server),
+			fmt.Sprintf("url=%v", m.conf.Server),
 		)
 	}
 
-	var awsSession *session.Session
-	if _, ok := m.conf["kubernetes.io/secret/aws_access_key_id"]; ok {
-		id, err := util.GetSecretString(m.conf, "aws_access_key_id")
-		if err != nil {
-			return err
-		}
-		secret, err := util.GetSecretString(m.conf, "aws_access_key")
-		if err != nil {
-			return err
-		}
-		awsSession, err = session.NewSession(&aws.Config{
-			Endpoint:    server,
-			Region:      region,
-			Credentials: credentials.NewStaticCredentials(id, secret, ""),
-		})
+	if m.conf.AccessKeyID != "" {
+		// Keys are passed through root-only file instead of command line,
+		// it is removed as soon as s3fs has read it.
+		passwdFile, err := util.WriteSecretFile("passwd-s3fs", []byte(m.conf.AccessKeyID+":"+m.conf.AccessKey))
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed write passwd file: %v", err)
 		}
-		args1 = append(args1,
-			"-e",
-			fmt.Sprintf("S3User=%s", id),
-			"-e",
-			fmt.Sprintf("S3Secret=%s", secret),
-		)
+		defer os.Remove(passwdFile)
+		spec.Mounts = append(spec.Mounts, util.DaemonMount{Source: passwdFile, Target: s3fsPasswdFile, ReadOnly: true})
+		spec.Args = append(spec.Args, "-o", "passwd_file="+s3fsPasswdFile)
 	} else {
-		awsSession, err = session.NewSession(&aws.Config{
-			Endpoint:                      server,
-			Region:                        region,
-			Credentials:                   credentials.AnonymousCredentials,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		})
-		if err != nil {
-			return err
-		}
-		args1 = append(
-			args1,
-			"-e",
-			"S3User=''",
-			"-e",
-			"S3Secret=''",
-		)
 		// Try to mount as public bucket.
-		args2 = append(
-			args2,
+		spec.Args = append(
+			spec.Args,
 			"-o",
 			"public_bucket=1",
 		)
 	}
-	s3s := s3.New(awsSession)
-	_, err = s3s.ListObjects(&s3.ListObjectsInput{
-		Bucket: &bucket,
-	})
+	awsSession, err := newSession(m.conf)
 	if err != nil {
-		m.slog.Warning(fmt.Sprintf("Get bucket location error %v", err))
-		return fmt.Errorf("Bucket request failed: %v", err)
+		return err
 	}
-	/*fp := base64.StdEncoding.EncodeToString([]byte(path))
-	if d,err := os.Open("/tmp/"+fp);err!=nil{
-		fpw,err := os.Create("/tmp/"+fp)
-		if err!=nil{
-			return fmt.Errorf("Failed create test sync",err)
-		}
-		fpw.WriteString("ok")
-		fpw.Close()
-		m.slog.Info("Sleep start")
-		time.Sleep(1*time.Minute)
-		m.slog.Info("Sleep end")
-	} else{
-		d.Close()
-	}*/
-	out, err := util.ExecCommand(m.exec, "docker", append(args1, args2...), "")
+	if err := m.checkBucket(s3.New(awsSession)); err != nil {
+		return err
+	}
+	id, err := m.rt.Run(spec)
 	if err != nil {
-		return fmt.Errorf("Failed mount s3fs out='%v' error='%v'", string(out), err)
-	} else {
-		m.slog.Info(fmt.Sprintf("Start conntainer result %s", string(out)))
+		return fmt.Errorf("Failed mount s3fs: %v", err)
 	}
-	return nil
+	m.slog.Info(fmt.Sprintf("Start conntainer result %s", id))
+	return util.WaitMountDaemon(m.slog, m.exec, m.rt, id, path, m.conf.MountTimeout)
 }
 
 func (m *S3FSMount) UnMount(path string) error {
-	// Unused ??
-	return nil
+	// Unmount first so the daemon can exit cleanly, then remove its container
+	// or stop the FUSE helper.
+	if isMounted, err := util.IsMounted(path); err != nil {
+		m.slog.Warning(fmt.Sprintf("Failed test mount '%s': %v", path, err))
+	} else if isMounted {
+		if err := syscall.Unmount(path, 0); err != nil {
+			return fmt.Errorf("Failed unmount '%s': %v", path, err)
+		}
+	}
+	if m.conf.Driver == ModeNative {
+		return share.StopHelper(fuseHelper, path)
+	}
+	return util.StopMountDaemons(path, m.rt)
 }
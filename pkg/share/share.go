@@ -2,13 +2,11 @@ package share
 
 import (
 	"fmt"
-	"log/syslog"
+	"reflect"
+	"sort"
+	"sync"
 
-	"github.com/kuberlab/s3share/pkg/share/download"
-	"github.com/kuberlab/s3share/pkg/share/git"
-	"github.com/kuberlab/s3share/pkg/share/plukefs"
-	"github.com/kuberlab/s3share/pkg/share/s3share"
-	"github.com/kuberlab/s3share/pkg/share/webdav"
+	"github.com/kuberlab/s3share/pkg/util"
 )
 
 type Share interface {
@@ -16,31 +14,110 @@ type Share interface {
 	UnMount(path string) error
 }
 
-func NewShare(slog *syslog.Writer, c map[string]interface{}) (Share, error) {
-	if t, ok := c["kuberlabFS"]; ok {
-		if s, ok := t.(string); ok {
-			if s == "" {
-				return nil, fmt.Errorf("FS type to share is not defined")
-			} else {
-				switch s {
-				case "download":
-					return download.NewDownloadMount(slog, c), nil
-				case "git":
-					return git.NewGitFSMount(slog, c), nil
-				case "plukefs":
-					return plukefs.NewPlukeFSMount(slog, c), nil
-				case "s3":
-					return s3share.NewS3FSMount(slog, c), nil
-				case "webdav":
-					return webdav.NewWebDavMount(slog, c), nil
-				default:
-					return nil, fmt.Errorf("FS type '%s' is not supported", s)
-				}
-			}
-		} else {
-			return nil, fmt.Errorf("Not supported FS type format")
-		}
-	} else {
+// Factory builds backend share from share options.
+type Factory func(slog util.Logger, exec util.Interface, c map[string]interface{}) (Share, error)
+
+// Option describes share option accepted by backend.
+type Option struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	// Secret options are taken from kubernetes.io/secret/<Name>.
+	Secret bool `json:"secret,omitempty"`
+	// Node options are taken only from node config, e.g. images of
+	// privileged daemons. Volumes setting them are refused.
+	Node bool `json:"node,omitempty"`
+}
+
+type backend struct {
+	factory Factory
+	config  reflect.Type
+	options []Option
+	modes   []AccessMode
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]backend)
+)
+
+// Register makes backend available by kuberlabFS name. Options schema
+// is taken from config struct tags, see DecodeConfig. Modes lists
+// supported access modes, any mode is accepted if it is empty.
+// It is intended to be called from backend init function and panics
+// if the name is registered twice or factory is nil.
+func Register(name string, factory Factory, config interface{}, modes ...AccessMode) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("share: Register factory is nil for " + name)
+	}
+	if _, dup := backends[name]; dup {
+		panic("share: Register called twice for " + name)
+	}
+	backends[name] = backend{
+		factory: factory,
+		config:  reflect.Indirect(reflect.ValueOf(config)).Type(),
+		options: ConfigOptions(config),
+		modes:   modes,
+	}
+}
+
+// Backends returns sorted names of registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewShare builds share described by options c, missing options
+// are taken from node config.
+func NewShare(slog util.Logger, node NodeConfig, c map[string]interface{}) (Share, error) {
+	return NewShareWithExec(slog, util.NewExec(), node, c)
+}
+
+// NewShareWithExec builds share which runs external commands through exec.
+func NewShareWithExec(slog util.Logger, exec util.Interface, node NodeConfig, c map[string]interface{}) (Share, error) {
+	return newShare(slog, exec, node, c, false)
+}
+
+// newShare builds share of options c. Recorded options were resolved on
+// the node and hold node options, options of a volume must not.
+func newShare(slog util.Logger, exec util.Interface, node NodeConfig, c map[string]interface{}, recorded bool) (Share, error) {
+	t, ok := c["kuberlabFS"]
+	if !ok {
+		return nil, fmt.Errorf("FS type to share is not defined")
+	}
+	s, ok := t.(string)
+	if !ok {
+		return nil, fmt.Errorf("Not supported FS type format")
+	}
+	if s == "" {
 		return nil, fmt.Errorf("FS type to share is not defined")
 	}
+	backendsMu.RLock()
+	b, ok := backends[s]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("FS type '%s' is not supported", s)
+	}
+	mode, err := RequestedAccessMode(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccessMode(s, b.modes, mode); err != nil {
+		return nil, err
+	}
+	if !recorded {
+		if errs := checkNodeOptions(b.options, c); len(errs) > 0 {
+			return nil, errs
+		}
+	}
+	return b.factory(slog, exec, node.withDefaults(s, c))
 }
@@ -2,24 +2,44 @@ package webdav
 
 import (
 	"fmt"
-	"log/syslog"
 	"strings"
 	"syscall"
 
+	"github.com/kuberlab/s3share/pkg/share"
 	"github.com/kuberlab/s3share/pkg/util"
 )
 
 type Mount struct {
-	slog *syslog.Writer
-	conf map[string]interface{}
+	slog util.Logger
+	conf *Config
 	exec util.Interface
 }
 
-func NewWebDavMount(slog *syslog.Writer, conf map[string]interface{}) *Mount {
+type Config struct {
+	share.Access
+	ServerURL  string `share:"serverURL" description:"WebDAV server URL, node IP on server_port by default"`
+	ServerPort int    `share:"server_port" default:"30802" description:"WebDAV port on the node if serverURL is not set"`
+	Workspace  string `share:"workspace,required" description:"Workspace which owns the dataset"`
+	Dataset    string `share:"dataset,required" description:"Dataset name"`
+	Version    string `share:"version,required" description:"Dataset version"`
+	Token      string `share:"token,secret" description:"Workspace secret"`
+}
+
+func init() {
+	share.Register("webdav", func(slog util.Logger, exec util.Interface, c map[string]interface{}) (share.Share, error) {
+		conf := &Config{}
+		if err := share.DecodeConfig(c, conf); err != nil {
+			return nil, err
+		}
+		return NewWebDavMount(slog, exec, conf), nil
+	}, &Config{})
+}
+
+func NewWebDavMount(slog util.Logger, exec util.Interface, conf *Config) *Mount {
 	return &Mount{
 		slog: slog,
 		conf: conf,
-		exec: util.NewExec(),
+		exec: exec,
 	}
 }
 
@@ -29,39 +49,31 @@ func (m *Mount) Mount(path string) error {
 	} else if isMounted {
 		return nil
 	}
-	urlRaw, ok := m.conf["serverURL"]
-	var url string
-	if !ok {
+	url := m.conf.ServerURL
+	if url == "" {
 		ip, err := util.LocalIP()
 		if err != nil {
 			return err
 		}
-		url = fmt.Sprintf("http://%v:30802/webdav", ip)
-	} else {
-		url = urlRaw.(string)
+		url = fmt.Sprintf("http://%v:%d/webdav", ip, m.conf.ServerPort)
 	}
 	url = strings.TrimSuffix(url, "/")
-	url = fmt.Sprintf("%v/%v/%v/%v", url, m.conf["workspace"], m.conf["dataset"], m.conf["version"])
+	url = fmt.Sprintf("%v/%v/%v/%v", url, m.conf.Workspace, m.conf.Dataset, m.conf.Version)
 
 	var user = "internal"
-	var password = ""
-	if _, ok := m.conf["kubernetes.io/secret/token"]; ok {
-		token, err := util.GetSecretString(m.conf, "token")
-		if err != nil {
-			return err
-		}
-		password = token
-	}
+	var password = m.conf.Token
 
-	// echo "pass" | mount -t davfs url path -o ro -o username='u'
-	out, err := util.ExecCommand(
-		m.exec,
-		"bash",
-		[]string{
-			"-c",
-			fmt.Sprintf(`echo "%v" | mount -t davfs "%v" "%v" -o ro -o username="%v"`, password, url, path, user)},
-		"",
+	// mount.davfs asks for password on stdin, so it never appears in the command line.
+	cmd := m.exec.Command(
+		"mount",
+		"-t", "davfs",
+		url,
+		path,
+		"-o", string(m.conf.Mode),
+		"-o", "username="+user,
 	)
+	cmd.SetStdin(strings.NewReader(password + "\n"))
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Failed mount davfs out='%v' error='%v'", string(out), err)
 	}
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MountPathLabel marks daemon container with path of the mount it serves.
+const MountPathLabel = "flex.mount.path"
+
+var ErrDaemonNotFound = errors.New("daemon container not found")
+
+// DaemonMount is a bind mount of a node path into daemon container.
+type DaemonMount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+	// Propagation is bind propagation, e.g. shared or rshared.
+	Propagation string
+}
+
+// DaemonSpec describes container to run.
+type DaemonSpec struct {
+	// Name is optional, runtime generates one if it is empty.
+	Name        string
+	Image       string
+	Args        []string
+	Env         []string
+	Labels      map[string]string
+	Mounts      []DaemonMount
+	Privileged  bool
+	CapAdd      []string
+	HostNetwork bool
+	// Restart makes runtime restart the container when it exits.
+	Restart bool
+}
+
+// DaemonState is state of daemon container.
+type DaemonState struct {
+	ID string
+	// Status is created, running, exited etc.
+	Status     string
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Labels     map[string]string
+}
+
+// Exited tells whether the container is not running anymore.
+func (s *DaemonState) Exited() bool {
+	return s.Status == "exited" || s.Status == "dead" || s.Status == "stopped"
+}
+
+// DaemonRuntime runs and tracks containers serving mounts.
+type DaemonRuntime interface {
+	// Run starts detached container and returns its ID.
+	Run(spec DaemonSpec) (string, error)
+	// Find returns IDs of all containers, running or not, having all labels.
+	// Empty label value matches any value.
+	Find(labels map[string]string) ([]string, error)
+	// Inspect returns state of container by ID or name,
+	// ErrDaemonNotFound if there is no such container.
+	Inspect(id string) (*DaemonState, error)
+	Logs(id string) (string, error)
+	// Remove kills and removes container.
+	Remove(id string) error
+}
+
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+	RuntimePodman     = "podman"
+)
+
+// NewDaemonRuntime returns runtime by name.
+func NewDaemonRuntime(name string, exec Interface) (DaemonRuntime, error) {
+	switch name {
+	case RuntimeDocker:
+		return NewDockerClient(DockerSocket), nil
+	case RuntimePodman:
+		return NewCLIRuntime(name, exec), nil
+	case RuntimeContainerd:
+		return NewContainerdRuntime(DefaultContainerdNamespace, exec), nil
+	}
+	return nil, fmt.Errorf("Unknown container runtime '%s', must be %s, %s or %s", name, RuntimeDocker, RuntimeContainerd, RuntimePodman)
+}
+
+// StopMountDaemons removes all daemon containers serving mount at path.
+func StopMountDaemons(path string, rt DaemonRuntime) error {
+	ids, err := MountDaemon(path, rt)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := StopDaemon(id, rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MountDaemon returns IDs of daemon containers serving mount at path.
+func MountDaemon(path string, rt DaemonRuntime) ([]string, error) {
+	ids, err := rt.Find(map[string]string{MountPathLabel: path})
+	if err != nil {
+		return nil, fmt.Errorf("Failed list daemon containers: %v", err)
+	}
+	return ids, nil
+}
+
+func CheckDaemon(id string, rt DaemonRuntime) error {
+	st, err := rt.Inspect(id)
+	if err != nil {
+		return err
+	}
+	if st.Exited() {
+		return fmt.Errorf("Daemon is %s with code %d", st.Status, st.ExitCode)
+	}
+	return nil
+}
+
+func StopDaemon(id string, rt DaemonRuntime) error {
+	if err := rt.Remove(id); err != nil {
+		return fmt.Errorf("Failed remove daemon container %v: %v", id, err)
+	}
+	return nil
+}
+
+// WaitMountDaemon waits until daemon container id mounts path. If the daemon
+// exits or timeout expires, the daemon is removed and its logs are returned as error.
+func WaitMountDaemon(slog Logger, exec Interface, rt DaemonRuntime, id string, path string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if isMounted, _ := IsMounted(path); isMounted {
+				return nil
+			}
+			if err := CheckDaemon(id, rt); err != nil {
+				logs, lerr := rt.Logs(id)
+				StopDaemon(id, rt)
+				ExecCommand(exec, "umount", []string{"-f", path}, "")
+				if lerr == nil && strings.TrimSpace(logs) != "" {
+					slog.Err(logs)
+					return errors.New(logs)
+				}
+				return fmt.Errorf("Failed mount: mount daemon has been failed: %v", err)
+			}
+		case <-timer.C:
+			slog.Err("Failed mount FS: timeout.")
+			StopDaemon(id, rt)
+			ExecCommand(exec, "umount", []string{"-f", path}, "")
+			return fmt.Errorf("Failed mount: timed out")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CLIRuntime runs daemons with docker compatible command line of bin,
+// podman is driven this way.
+type CLIRuntime struct {
+	bin  string
+	exec Interface
+}
+
+func NewCLIRuntime(bin string, exec Interface) *CLIRuntime {
+	return &CLIRuntime{bin: bin, exec: exec}
+}
+
+func (r *CLIRuntime) Run(spec DaemonSpec) (string, error) {
+	args := []string{"run", "-d"}
+	if spec.Name != "" {
+		args = append(args, "--name", spec.Name)
+	}
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	for _, c := range spec.CapAdd {
+		args = append(args, "--cap-add", c)
+	}
+	if spec.HostNetwork {
+		args = append(args, "--network", "host")
+	}
+	if spec.Restart {
+		args = append(args, "--restart", "always")
+	}
+	for _, k := range sortedKeys(spec.Labels) {
+		args = append(args, "--label", k+"="+spec.Labels[k])
+	}
+	for _, m := range spec.Mounts {
+		opt := "type=bind,source=" + m.Source + ",target=" + m.Target
+		if m.ReadOnly {
+			opt += ",readonly"
+		}
+		if m.Propagation != "" {
+			opt += ",bind-propagation=" + m.Propagation
+		}
+		args = append(args, "--mount", opt)
+	}
+	// Values are taken from the environment of the command,
+	// so they don't show up in the process list.
+	for _, e := range spec.Env {
+		args = append(args, "-e", strings.SplitN(e, "=", 2)[0])
+	}
+	args = append(args, spec.Image)
+	args = append(args, spec.Args...)
+	cmd := r.exec.Command(r.bin, args...)
+	if len(spec.Env) > 0 {
+		cmd.SetEnv(spec.Env)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Output may start with image pull progress.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
+func (r *CLIRuntime) Find(labels map[string]string) ([]string, error) {
+	args := []string{"ps", "-a", "-q", "--no-trunc"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--filter", "label="+labelFilter(k, labels[k]))
+	}
+	out, err := ExecCommand(r.exec, r.bin, args, "")
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (r *CLIRuntime) Inspect(id string) (*DaemonState, error) {
+	out, err := ExecCommand(r.exec, r.bin, []string{"inspect", "--type", "container", "--format", "{{ json . }}", id}, "")
+	if err != nil {
+		if strings.Contains(strings.ToLower(string(out)), "no such") {
+			return nil, ErrDaemonNotFound
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	var c containerJSON
+	if err := json.Unmarshal(out, &c); err != nil {
+		return nil, fmt.Errorf("Failed parse %s inspect output: %v", r.bin, err)
+	}
+	return c.state(), nil
+}
+
+func (r *CLIRuntime) Logs(id string) (string, error) {
+	out, err := ExecCommand(r.exec, r.bin, []string{"logs", id}, "")
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func (r *CLIRuntime) Remove(id string) error {
+	out, err := ExecCommand(r.exec, r.bin, []string{"rm", "--force", id}, "")
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func labelFilter(k, v string) string {
+	if v == "" {
+		return k
+	}
+	return k + "=" + v
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cmdRecorder answers commands with out and err and keeps them with
+// environment they were given.
+type cmdRecorder struct {
+	cmds []*FakeCmd
+}
+
+func (r *cmdRecorder) action(out string, err error) FakeCommandAction {
+	return func(cmd string, args ...string) Cmd {
+		fake := &FakeCmd{CombinedOutputScript: []FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(out), err },
+		}}
+		r.cmds = append(r.cmds, fake)
+		return InitFakeCmd(fake, cmd, args...)
+	}
+}
+
+// testDaemonSpec is a privileged daemon with a secret passed through
+// environment and a read-only secret file.
+func testDaemonSpec() DaemonSpec {
+	return DaemonSpec{
+		Name:   "daemon",
+		Image:  "kuberlab/s3fs",
+		Args:   []string{"s3fs", "bucket", "-o", "passwd_file=/run/s3share/passwd-s3fs"},
+		Env:    []string{"AWSSECRETACCESSKEY=s3cr3t"},
+		Labels: map[string]string{MountPathLabel: "/mnt/data", "flex.mount.image": "kuberlab/s3fs"},
+		Mounts: []DaemonMount{
+			{Source: "/mnt/data", Target: "/mnt/mountpoint", Propagation: "shared"},
+			{Source: "/tmp/passwd-s3fs123", Target: "/run/s3share/passwd-s3fs", ReadOnly: true},
+		},
+		Privileged: true,
+		CapAdd:     []string{"SYS_ADMIN"},
+		Restart:    true,
+	}
+}
+
+func TestCLIRun(t *testing.T) {
+	r := &cmdRecorder{}
+	rt := NewCLIRuntime("podman", &FakeExec{CommandScript: []FakeCommandAction{
+		r.action("Trying to pull kuberlab/s3fs...\nc0ffee\n", nil),
+	}})
+	id, err := rt.Run(testDaemonSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "c0ffee" {
+		t.Errorf("got id '%s'", id)
+	}
+	want := []string{
+		"podman", "run", "-d", "--name", "daemon", "--privileged", "--cap-add", "SYS_ADMIN", "--restart", "always",
+		"--label", "flex.mount.image=kuberlab/s3fs", "--label", MountPathLabel + "=/mnt/data",
+		"--mount", "type=bind,source=/mnt/data,target=/mnt/mountpoint,bind-propagation=shared",
+		"--mount", "type=bind,source=/tmp/passwd-s3fs123,target=/run/s3share/passwd-s3fs,readonly",
+		"-e", "AWSSECRETACCESSKEY",
+		"kuberlab/s3fs", "s3fs", "bucket", "-o", "passwd_file=/run/s3share/passwd-s3fs",
+	}
+	cmd := r.cmds[0]
+	if !reflect.DeepEqual(cmd.Argv, want) {
+		t.Errorf("got argv %q\nwant %q", cmd.Argv, want)
+	}
+	// Secret values are given through environment of podman, not its argv.
+	if !reflect.DeepEqual(cmd.Env, []string{"AWSSECRETACCESSKEY=s3cr3t"}) {
+		t.Errorf("got env %q", cmd.Env)
+	}
+}
+
+func TestCLIRunError(t *testing.T) {
+	log := &FakeCommandLog{}
+	rt := NewCLIRuntime("podman", &FakeExec{CommandScript: []FakeCommandAction{
+		log.Action("Error: image not known\n", FakeExitError{Status: 125}),
+	}})
+	_, err := rt.Run(DaemonSpec{Image: "kuberlab/missing"})
+	if err == nil || !strings.Contains(err.Error(), "image not known") {
+		t.Errorf("got %v, want run error", err)
+	}
+}
+
+func TestCLIRemove(t *testing.T) {
+	log := &FakeCommandLog{}
+	rt := NewCLIRuntime("podman", &FakeExec{CommandScript: []FakeCommandAction{
+		log.Action("c0ffee\n", nil),
+		log.Action("", nil),
+		log.Action("Error: no such container c0ffee\n", FakeExitError{Status: 125}),
+	}})
+	ids, err := rt.Find(map[string]string{MountPathLabel: "/mnt/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StopDaemon(ids[0], rt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Inspect(ids[0]); err != ErrDaemonNotFound {
+		t.Errorf("got %v after remove, want %v", err, ErrDaemonNotFound)
+	}
+	want := [][]string{
+		{"podman", "ps", "-a", "-q", "--no-trunc", "--filter", "label=" + MountPathLabel + "=/mnt/data"},
+		{"podman", "rm", "--force", "c0ffee"},
+		{"podman", "inspect", "--type", "container", "--format", "{{ json . }}", "c0ffee"},
+	}
+	if !reflect.DeepEqual(log.Cmds, want) {
+		t.Errorf("got commands %q\nwant %q", log.Cmds, want)
+	}
+}
+
+func TestCLIRemoveError(t *testing.T) {
+	log := &FakeCommandLog{}
+	rt := NewCLIRuntime("podman", &FakeExec{CommandScript: []FakeCommandAction{
+		log.Action("Error: container is paused\n", errors.New("exit status 125")),
+	}})
+	if err := StopDaemon("c0ffee", rt); err == nil || !strings.Contains(err.Error(), "container is paused") {
+		t.Errorf("got %v, want remove error", err)
+	}
+}
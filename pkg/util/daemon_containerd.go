@@ -0,0 +1,209 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultContainerdNamespace = "kuberlab-share"
+
+// ContainerdLogDir keeps daemon output, ctr doesn't store it.
+// It is a variable so tests can keep logs in a temp dir.
+var ContainerdLogDir = "/var/log/kuberlab-share"
+
+// ContainerdRuntime runs daemons with containerd through ctr
+// in a namespace of its own, so they are invisible to kubelet.
+type ContainerdRuntime struct {
+	namespace string
+	exec      Interface
+}
+
+func NewContainerdRuntime(namespace string, exec Interface) *ContainerdRuntime {
+	return &ContainerdRuntime{namespace: namespace, exec: exec}
+}
+
+func (r *ContainerdRuntime) ctr(args ...string) ([]byte, error) {
+	out, err := ExecCommand(r.exec, "ctr", append([]string{"-n", r.namespace}, args...), "")
+	if err != nil {
+		return out, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (r *ContainerdRuntime) Run(spec DaemonSpec) (string, error) {
+	image := normalizeImage(spec.Image)
+	out, err := r.ctr("images", "ls", "-q", "name=="+image)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		if _, err := r.ctr("images", "pull", image); err != nil {
+			return "", err
+		}
+	}
+	id := spec.Name
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = "share-" + hex.EncodeToString(b)
+	}
+	if err := os.MkdirAll(ContainerdLogDir, 0700); err != nil {
+		return "", err
+	}
+	args := []string{"run", "-d", "--log-uri", "file://" + r.logFile(id)}
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	for _, c := range spec.CapAdd {
+		args = append(args, "--cap-add", "CAP_"+strings.TrimPrefix(strings.ToUpper(c), "CAP_"))
+	}
+	if spec.HostNetwork {
+		args = append(args, "--net-host")
+	}
+	labels := spec.Labels
+	if spec.Restart {
+		// Honoured by containerd restart monitor if it is enabled.
+		labels = make(map[string]string, len(spec.Labels)+1)
+		for k, v := range spec.Labels {
+			labels[k] = v
+		}
+		labels["containerd.io/restart.status"] = "running"
+	}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	for _, m := range spec.Mounts {
+		opts := []string{"rbind", "rw"}
+		if m.ReadOnly {
+			opts[1] = "ro"
+		}
+		if m.Propagation != "" {
+			opts = append(opts, m.Propagation)
+		}
+		args = append(args, "--mount", "type=bind,src="+m.Source+",dst="+m.Target+",options="+strings.Join(opts, ":"))
+	}
+	if len(spec.Env) > 0 {
+		// Env file keeps values out of the process list.
+		envFile, err := WriteSecretFile("ctr-env", []byte(strings.Join(spec.Env, "\n")+"\n"))
+		if err != nil {
+			return "", fmt.Errorf("Failed write env file: %v", err)
+		}
+		defer os.Remove(envFile)
+		args = append(args, "--env-file", envFile)
+	}
+	args = append(args, image, id)
+	args = append(args, spec.Args...)
+	if _, err := r.ctr(args...); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (r *ContainerdRuntime) Find(labels map[string]string) ([]string, error) {
+	var filters []string
+	for _, k := range sortedKeys(labels) {
+		f := "labels." + strconv.Quote(k)
+		if v := labels[k]; v != "" {
+			f += "==" + strconv.Quote(v)
+		}
+		filters = append(filters, f)
+	}
+	args := []string{"containers", "ls", "-q"}
+	if len(filters) > 0 {
+		args = append(args, strings.Join(filters, ","))
+	}
+	out, err := r.ctr(args...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (r *ContainerdRuntime) Inspect(id string) (*DaemonState, error) {
+	out, err := r.ctr("containers", "info", id)
+	if err != nil {
+		if strings.Contains(string(out), "not found") {
+			return nil, ErrDaemonNotFound
+		}
+		return nil, err
+	}
+	var info struct {
+		ID        string
+		Labels    map[string]string
+		CreatedAt time.Time
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("Failed parse ctr containers info output: %v", err)
+	}
+	// ctr doesn't tell when task started, container is created right before.
+	st := &DaemonState{ID: info.ID, Labels: info.Labels, Status: "created", StartedAt: info.CreatedAt}
+	out, err = r.ctr("tasks", "ls")
+	if err != nil {
+		return nil, err
+	}
+	// TASK    PID    STATUS
+	for _, line := range strings.Split(string(out), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == id {
+			st.Status = strings.ToLower(f[2])
+		}
+	}
+	if st.Status == "stopped" {
+		st.Status = "exited"
+		if fi, err := os.Stat(r.logFile(id)); err == nil {
+			st.FinishedAt = fi.ModTime()
+		}
+	}
+	return st, nil
+}
+
+func (r *ContainerdRuntime) Logs(id string) (string, error) {
+	data, err := ioutil.ReadFile(r.logFile(id))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (r *ContainerdRuntime) Remove(id string) error {
+	if out, err := r.ctr("tasks", "delete", "--force", id); err != nil && !strings.Contains(string(out), "not found") {
+		return err
+	}
+	if out, err := r.ctr("containers", "delete", id); err != nil && !strings.Contains(string(out), "not found") {
+		return err
+	}
+	os.Remove(r.logFile(id))
+	return nil
+}
+
+func (r *ContainerdRuntime) logFile(id string) string {
+	return filepath.Join(ContainerdLogDir, r.namespace+"-"+id+".log")
+}
+
+// normalizeImage turns docker image reference into the full one ctr expects:
+// kuberlab/s3fs becomes docker.io/kuberlab/s3fs:latest.
+func normalizeImage(image string) string {
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		image = "docker.io/library/" + image
+	} else if !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		image = "docker.io/" + image
+	}
+	last := name[strings.LastIndex(name, "/")+1:]
+	if !strings.Contains(last, ":") && !strings.Contains(image, "@") {
+		image += ":latest"
+	}
+	return image
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestContainerd(t *testing.T, script ...FakeCommandAction) *ContainerdRuntime {
+	ContainerdLogDir = t.TempDir()
+	return NewContainerdRuntime(DefaultContainerdNamespace, &FakeExec{CommandScript: script})
+}
+
+func TestContainerdRun(t *testing.T) {
+	log := &FakeCommandLog{}
+	var env string
+	var envMode os.FileMode
+	run := func(cmd string, args ...string) Cmd {
+		// Env file exists only while ctr runs.
+		for i, a := range args {
+			if a == "--env-file" {
+				data, _ := ioutil.ReadFile(args[i+1])
+				env = string(data)
+				if fi, err := os.Stat(args[i+1]); err == nil {
+					envMode = fi.Mode().Perm()
+				}
+			}
+		}
+		return log.Action("", nil)(cmd, args...)
+	}
+	rt := newTestContainerd(t,
+		log.Action("", nil),
+		log.Action("", nil),
+		run,
+	)
+	id, err := rt.Run(testDaemonSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "daemon" {
+		t.Errorf("got id '%s'", id)
+	}
+	image := "docker.io/kuberlab/s3fs:latest"
+	if len(log.Cmds) != 3 {
+		t.Fatalf("got commands %q", log.Cmds)
+	}
+	if want := []string{"ctr", "-n", "kuberlab-share", "images", "pull", image}; !reflect.DeepEqual(log.Cmds[1], want) {
+		t.Errorf("got pull %q", log.Cmds[1])
+	}
+	argv := log.Cmds[2]
+	envFile := ""
+	for i, a := range argv {
+		if a == "--env-file" {
+			envFile = argv[i+1]
+		}
+	}
+	want := []string{
+		"ctr", "-n", "kuberlab-share", "run", "-d", "--log-uri", "file://" + filepath.Join(ContainerdLogDir, "kuberlab-share-daemon.log"),
+		"--privileged", "--cap-add", "CAP_SYS_ADMIN",
+		"--label", "containerd.io/restart.status=running",
+		"--label", "flex.mount.image=kuberlab/s3fs", "--label", MountPathLabel + "=/mnt/data",
+		"--mount", "type=bind,src=/mnt/data,dst=/mnt/mountpoint,options=rbind:rw:shared",
+		"--mount", "type=bind,src=/tmp/passwd-s3fs123,dst=/run/s3share/passwd-s3fs,options=rbind:ro",
+		"--env-file", envFile,
+		image, "daemon", "s3fs", "bucket", "-o", "passwd_file=/run/s3share/passwd-s3fs",
+	}
+	if !reflect.DeepEqual(argv, want) {
+		t.Errorf("got argv %q\nwant %q", argv, want)
+	}
+	if strings.Contains(strings.Join(argv, " "), "s3cr3t") {
+		t.Errorf("secret is in argv %q", argv)
+	}
+	if env != "AWSSECRETACCESSKEY=s3cr3t\n" || envMode != 0600 {
+		t.Errorf("got env file %q mode %v", env, envMode)
+	}
+	if _, err := os.Stat(envFile); !os.IsNotExist(err) {
+		t.Errorf("env file %s is left: %v", envFile, err)
+	}
+}
+
+func TestContainerdRunPresentImage(t *testing.T) {
+	log := &FakeCommandLog{}
+	rt := newTestContainerd(t,
+		log.Action("sha256:0123\n", nil),
+		log.Action("", nil),
+	)
+	id, err := rt.Run(DaemonSpec{Image: "registry:5000/plukefs:1.2", Args: []string{"plukefs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "share-") {
+		t.Errorf("got id '%s'", id)
+	}
+	argv := log.Cmds[1]
+	if argv[3] != "run" || strings.Contains(strings.Join(argv, " "), "--privileged") || strings.Contains(strings.Join(argv, " "), "--env-file") {
+		t.Errorf("got argv %q", argv)
+	}
+	if tail := argv[len(argv)-3:]; !reflect.DeepEqual(tail, []string{"registry:5000/plukefs:1.2", id, "plukefs"}) {
+		t.Errorf("got argv %q", argv)
+	}
+}
+
+func TestContainerdRemove(t *testing.T) {
+	log := &FakeCommandLog{}
+	rt := newTestContainerd(t,
+		log.Action("", nil),
+		log.Action("", nil),
+		// Task of an exited daemon may be gone already.
+		log.Action("ctr: task daemon: not found\n", FakeExitError{Status: 1}),
+		log.Action("", nil),
+	)
+	logFile := filepath.Join(ContainerdLogDir, "kuberlab-share-daemon.log")
+	if err := ioutil.WriteFile(logFile, []byte("mounted\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopDaemon("daemon", rt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Errorf("log file is left: %v", err)
+	}
+	if err := rt.Remove("daemon"); err != nil {
+		t.Errorf("remove of exited daemon: %v", err)
+	}
+	want := [][]string{
+		{"ctr", "-n", "kuberlab-share", "tasks", "delete", "--force", "daemon"},
+		{"ctr", "-n", "kuberlab-share", "containers", "delete", "daemon"},
+		{"ctr", "-n", "kuberlab-share", "tasks", "delete", "--force", "daemon"},
+		{"ctr", "-n", "kuberlab-share", "containers", "delete", "daemon"},
+	}
+	if !reflect.DeepEqual(log.Cmds, want) {
+		t.Errorf("got commands %q\nwant %q", log.Cmds, want)
+	}
+}
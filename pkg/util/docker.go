@@ -0,0 +1,344 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DockerSocket = "/var/run/docker.sock"
+	// dockerAPIVersion is the oldest API having HostConfig.Mounts.
+	dockerAPIVersion = "v1.25"
+	dockerTimeout    = 30 * time.Second
+	// dockerPullTimeout bounds image pull done before container start.
+	dockerPullTimeout = 10 * time.Minute
+)
+
+// DockerError is an error response of Docker Engine API.
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("docker: %s (%d)", e.Message, e.StatusCode)
+}
+
+// DockerClient talks to Docker Engine API over unix socket.
+type DockerClient struct {
+	client *http.Client
+}
+
+var _ DaemonRuntime = &DockerClient{}
+
+func NewDockerClient(socket string) *DockerClient {
+	return &DockerClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends request and decodes JSON response into out if it is not nil.
+func (c *DockerClient) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	resp, err := c.request(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("docker: bad response of %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// request sends request, non 2xx and 304 responses are returned as DockerError.
+func (c *DockerClient) request(ctx context.Context, method, path string, query url.Values, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	u := "http://docker/" + dockerAPIVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker: %v", err)
+	}
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(data))
+	}
+	return nil, &DockerError{StatusCode: resp.StatusCode, Message: msg.Message}
+}
+
+func isNotFound(err error) bool {
+	de, ok := err.(*DockerError)
+	return ok && de.StatusCode == http.StatusNotFound
+}
+
+type dockerMount struct {
+	Type        string
+	Source      string
+	Target      string
+	ReadOnly    bool `json:",omitempty"`
+	BindOptions *struct {
+		Propagation string
+	} `json:",omitempty"`
+}
+
+type dockerCreate struct {
+	Image      string
+	Cmd        []string          `json:",omitempty"`
+	Env        []string          `json:",omitempty"`
+	Labels     map[string]string `json:",omitempty"`
+	HostConfig struct {
+		Privileged    bool     `json:",omitempty"`
+		CapAdd        []string `json:",omitempty"`
+		NetworkMode   string   `json:",omitempty"`
+		Mounts        []dockerMount
+		RestartPolicy struct {
+			Name string `json:",omitempty"`
+		}
+	}
+}
+
+func (c *DockerClient) Run(spec DaemonSpec) (string, error) {
+	req := dockerCreate{
+		Image:  spec.Image,
+		Cmd:    spec.Args,
+		Env:    spec.Env,
+		Labels: spec.Labels,
+	}
+	req.HostConfig.Privileged = spec.Privileged
+	req.HostConfig.CapAdd = spec.CapAdd
+	if spec.HostNetwork {
+		req.HostConfig.NetworkMode = "host"
+	}
+	if spec.Restart {
+		req.HostConfig.RestartPolicy.Name = "always"
+	}
+	for _, m := range spec.Mounts {
+		dm := dockerMount{Type: "bind", Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+		if m.Propagation != "" {
+			dm.BindOptions = &struct{ Propagation string }{m.Propagation}
+		}
+		req.HostConfig.Mounts = append(req.HostConfig.Mounts, dm)
+	}
+	query := url.Values{}
+	if spec.Name != "" {
+		query.Set("name", spec.Name)
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	create := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+		defer cancel()
+		return c.do(ctx, "POST", "/containers/create", query, req, &created)
+	}
+	err := create()
+	if isNotFound(err) {
+		// No such image.
+		if err := c.pull(spec.Image); err != nil {
+			return "", err
+		}
+		err = create()
+	}
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	if err := c.do(ctx, "POST", "/containers/"+created.ID+"/start", nil, nil, nil); err != nil {
+		c.Remove(created.ID)
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// pullQuery returns query of image pull. Image pinned by digest is passed
+// whole in fromImage, tag would be taken for a tag name.
+func pullQuery(image string) url.Values {
+	if strings.Contains(image, "@") {
+		return url.Values{"fromImage": {image}}
+	}
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	return url.Values{"fromImage": {name}, "tag": {tag}}
+}
+
+// pull pulls image, failure is reported in progress stream.
+func (c *DockerClient) pull(image string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerPullTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, "POST", "/images/create", pullQuery(image), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("docker: failed pull %s: %v", image, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("docker: failed pull %s: %s", image, msg.Error)
+		}
+	}
+}
+
+func (c *DockerClient) Find(labels map[string]string) ([]string, error) {
+	var filter []string
+	for _, k := range sortedKeys(labels) {
+		filter = append(filter, labelFilter(k, labels[k]))
+	}
+	filters, _ := json.Marshal(map[string][]string{"label": filter})
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	if err := c.do(ctx, "GET", "/containers/json", url.Values{"all": {"1"}, "filters": {string(filters)}}, nil, &list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list))
+	for _, l := range list {
+		ids = append(ids, l.ID)
+	}
+	return ids, nil
+}
+
+// containerJSON is the part of container inspect response we use,
+// docker and podman share it.
+type containerJSON struct {
+	ID    string `json:"Id"`
+	State struct {
+		Status     string
+		ExitCode   int
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	Config struct {
+		Labels map[string]string
+	}
+}
+
+func (c containerJSON) state() *DaemonState {
+	return &DaemonState{
+		ID:         c.ID,
+		Status:     c.State.Status,
+		ExitCode:   c.State.ExitCode,
+		StartedAt:  c.State.StartedAt,
+		FinishedAt: c.State.FinishedAt,
+		Labels:     c.Config.Labels,
+	}
+}
+
+func (c *DockerClient) Inspect(id string) (*DaemonState, error) {
+	var cj containerJSON
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	if err := c.do(ctx, "GET", "/containers/"+url.PathEscape(id)+"/json", nil, nil, &cj); err != nil {
+		if isNotFound(err) {
+			return nil, ErrDaemonNotFound
+		}
+		return nil, err
+	}
+	return cj.state(), nil
+}
+
+func (c *DockerClient) Logs(id string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, "GET", "/containers/"+url.PathEscape(id)+"/logs", url.Values{"stdout": {"1"}, "stderr": {"1"}}, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return "", ErrDaemonNotFound
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(demuxLogs(data)), nil
+}
+
+// demuxLogs strips stream headers docker adds to output of containers
+// without TTY: 1 byte stream, 3 zero bytes, 4 bytes big endian size.
+func demuxLogs(data []byte) []byte {
+	var out []byte
+	for len(data) >= 8 {
+		if data[0] > 2 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+			// TTY output, it isn't multiplexed.
+			return append(out, data...)
+		}
+		n := int(binary.BigEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if n > len(data) {
+			n = len(data)
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return append(out, data...)
+}
+
+func (c *DockerClient) Remove(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	err := c.do(ctx, "DELETE", "/containers/"+url.PathEscape(id), url.Values{"force": {"1"}}, nil, nil)
+	if isNotFound(err) {
+		return ErrDaemonNotFound
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package util
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker serves the part of Docker Engine API DockerClient uses.
+// Images have to be pulled before containers are created from them.
+type fakeDocker struct {
+	mu         sync.Mutex
+	images     map[string]bool
+	containers map[string]*dockerCreate
+	started    map[string]bool
+	pulls      []url.Values
+	// pullError is reported in pull progress stream if set.
+	pullError string
+	logs      []byte
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, *DockerClient) {
+	f := &fakeDocker{
+		images:     map[string]bool{},
+		containers: map[string]*dockerCreate{},
+		started:    map[string]bool{},
+	}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.StripPrefix("/"+dockerAPIVersion, f))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return f, NewDockerClient(socket)
+}
+
+func dockerNotFound(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/images/create":
+		q := r.URL.Query()
+		f.pulls = append(f.pulls, q)
+		if f.pullError != "" {
+			io.WriteString(w, `{"status":"Pulling"}`+"\n"+`{"error":"`+f.pullError+`"}`+"\n")
+			return
+		}
+		image := q.Get("fromImage")
+		if tag := q.Get("tag"); tag != "" {
+			image += ":" + tag
+		}
+		f.images[image] = true
+		io.WriteString(w, `{"status":"Pulling"}`+"\n"+`{"status":"Downloaded"}`+"\n")
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		req := &dockerCreate{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !f.images[req.Image] && !f.images[req.Image+":latest"] {
+			dockerNotFound(w, "No such image: "+req.Image)
+			return
+		}
+		id := "c" + r.URL.Query().Get("name")
+		f.containers[id] = req
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case len(parts) < 2 || parts[0] != "containers":
+		http.NotFound(w, r)
+	case f.containers[parts[1]] == nil:
+		dockerNotFound(w, "No such container: "+parts[1])
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "start":
+		f.started[parts[1]] = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && len(parts) == 3 && parts[2] == "json":
+		var cj containerJSON
+		cj.ID = parts[1]
+		cj.State.Status = "running"
+		cj.Config.Labels = f.containers[parts[1]].Labels
+		json.NewEncoder(w).Encode(cj)
+	case r.Method == "GET" && len(parts) == 3 && parts[2] == "logs":
+		w.Write(f.logs)
+	case r.Method == "DELETE" && len(parts) == 2:
+		delete(f.containers, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDockerRunPullsMissingImage(t *testing.T) {
+	f, c := newFakeDocker(t)
+	id, err := c.Run(DaemonSpec{
+		Name:   "daemon",
+		Image:  "kuberlab/s3fs",
+		Args:   []string{"s3fs", "bucket"},
+		Env:    []string{"AWSACCESSKEYID"},
+		Labels: map[string]string{MountPathLabel: "/mnt/data"},
+		Mounts: []DaemonMount{
+			{Source: "/mnt/data", Target: "/mnt/mountpoint", Propagation: "shared"},
+			{Source: "/etc/ssl", Target: "/etc/ssl", ReadOnly: true},
+		},
+		Privileged:  true,
+		HostNetwork: true,
+		Restart:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.pulls) != 1 || f.pulls[0].Get("fromImage") != "kuberlab/s3fs" || f.pulls[0].Get("tag") != "latest" {
+		t.Errorf("got pulls %v", f.pulls)
+	}
+	if !f.started[id] {
+		t.Errorf("container %s is not started", id)
+	}
+	req := f.containers[id]
+	if !reflect.DeepEqual(req.Cmd, []string{"s3fs", "bucket"}) || !reflect.DeepEqual(req.Env, []string{"AWSACCESSKEYID"}) {
+		t.Errorf("got cmd %v env %v", req.Cmd, req.Env)
+	}
+	hc := req.HostConfig
+	if !hc.Privileged || hc.NetworkMode != "host" || hc.RestartPolicy.Name != "always" {
+		t.Errorf("got host config %+v", hc)
+	}
+	if len(hc.Mounts) != 2 {
+		t.Fatalf("got mounts %+v", hc.Mounts)
+	}
+	if m := hc.Mounts[0]; m.Type != "bind" || m.Source != "/mnt/data" || m.Target != "/mnt/mountpoint" ||
+		m.ReadOnly || m.BindOptions == nil || m.BindOptions.Propagation != "shared" {
+		t.Errorf("got mount %+v", m)
+	}
+	if m := hc.Mounts[1]; !m.ReadOnly || m.BindOptions != nil {
+		t.Errorf("got mount %+v", m)
+	}
+
+	st, err := c.Inspect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Status != "running" || st.Labels[MountPathLabel] != "/mnt/data" {
+		t.Errorf("got state %+v", st)
+	}
+}
+
+func TestDockerPullQuery(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		image     string
+		fromImage string
+		tag       string
+	}{
+		{"kuberlab/s3fs", "kuberlab/s3fs", "latest"},
+		{"kuberlab/plukefs:1.2", "kuberlab/plukefs", "1.2"},
+		{"registry:5000/plukefs", "registry:5000/plukefs", "latest"},
+		{"registry:5000/plukefs:1.2", "registry:5000/plukefs", "1.2"},
+		{"kuberlab/s3fs@" + digest, "kuberlab/s3fs@" + digest, ""},
+		{"registry:5000/s3fs:1.2@" + digest, "registry:5000/s3fs:1.2@" + digest, ""},
+	}
+	for _, c := range cases {
+		q := pullQuery(c.image)
+		if q.Get("fromImage") != c.fromImage || q.Get("tag") != c.tag {
+			t.Errorf("%s: got fromImage '%s' tag '%s'", c.image, q.Get("fromImage"), q.Get("tag"))
+		}
+	}
+}
+
+func TestDockerRunPullsByDigest(t *testing.T) {
+	f, c := newFakeDocker(t)
+	image := "kuberlab/s3fs@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	if _, err := c.Run(DaemonSpec{Image: image}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.pulls) != 1 || f.pulls[0].Get("fromImage") != image {
+		t.Errorf("got pulls %v", f.pulls)
+	}
+}
+
+func TestDockerPullError(t *testing.T) {
+	f, c := newFakeDocker(t)
+	f.pullError = "manifest unknown"
+	_, err := c.Run(DaemonSpec{Image: "kuberlab/missing:1.0"})
+	if err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("got %v, want pull error", err)
+	}
+	if len(f.containers) != 0 {
+		t.Errorf("got containers %v", f.containers)
+	}
+}
+
+func TestDockerNotFound(t *testing.T) {
+	_, c := newFakeDocker(t)
+	if _, err := c.Inspect("missing"); err != ErrDaemonNotFound {
+		t.Errorf("inspect: got %v, want %v", err, ErrDaemonNotFound)
+	}
+	if err := c.Remove("missing"); err != ErrDaemonNotFound {
+		t.Errorf("remove: got %v, want %v", err, ErrDaemonNotFound)
+	}
+	if _, err := c.Logs("missing"); err != ErrDaemonNotFound {
+		t.Errorf("logs: got %v, want %v", err, ErrDaemonNotFound)
+	}
+}
+
+func TestDockerRemove(t *testing.T) {
+	f, c := newFakeDocker(t)
+	f.images["kuberlab/s3fs:latest"] = true
+	id, err := c.Run(DaemonSpec{Name: "daemon", Image: "kuberlab/s3fs:latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.pulls) != 0 {
+		t.Errorf("present image is pulled: %v", f.pulls)
+	}
+	if err := c.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Inspect(id); err != ErrDaemonNotFound {
+		t.Errorf("got %v after remove, want %v", err, ErrDaemonNotFound)
+	}
+}
+
+func logFrame(stream byte, s string) []byte {
+	frame := make([]byte, 8, 8+len(s))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(s)))
+	return append(frame, s...)
+}
+
+func TestDemuxLogs(t *testing.T) {
+	var muxed []byte
+	muxed = append(muxed, logFrame(1, "mounted\n")...)
+	muxed = append(muxed, logFrame(2, "warning: slow\n")...)
+	muxed = append(muxed, logFrame(1, "done\n")...)
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"multiplexed", muxed, "mounted\nwarning: slow\ndone\n"},
+		{"tty", []byte("plain output without headers\n"), "plain output without headers\n"},
+		{"truncated", append(logFrame(1, "first\n"), logFrame(2, "second\n")[:11]...), "first\nsec"},
+		{"empty", nil, ""},
+	}
+	for _, c := range cases {
+		if got := string(demuxLogs(c.data)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDockerLogs(t *testing.T) {
+	f, c := newFakeDocker(t)
+	f.images["kuberlab/s3fs:latest"] = true
+	id, err := c.Run(DaemonSpec{Image: "kuberlab/s3fs:latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.logs = append(logFrame(1, "out\n"), logFrame(2, "err\n")...)
+	logs, err := c.Logs(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs != "out\nerr\n" {
+		t.Errorf("got logs %q", logs)
+	}
+}
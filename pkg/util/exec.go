@@ -2,6 +2,7 @@ package util
 
 import (
 	"io"
+	"os"
 	osexec "os/exec"
 	"syscall"
 	"time"
@@ -31,6 +32,8 @@ type Cmd interface {
 	// Output runs the command and returns standard output, but not standard err
 	Output() ([]byte, error)
 	SetDir(dir string)
+	// SetEnv adds variables to the environment inherited from current process.
+	SetEnv(env []string)
 	SetStdin(in io.Reader)
 	SetStdout(out io.Writer)
 	// Stops the command by sending SIGTERM. It is not guaranteed the
@@ -75,6 +78,10 @@ func (cmd *cmdWrapper) SetDir(dir string) {
 	cmd.Dir = dir
 }
 
+func (cmd *cmdWrapper) SetEnv(env []string) {
+	cmd.Env = append(os.Environ(), env...)
+}
+
 func (cmd *cmdWrapper) SetStdin(in io.Reader) {
 	cmd.Stdin = in
 }
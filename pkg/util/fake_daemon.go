@@ -0,0 +1,139 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeDaemonRuntime keeps daemons in memory for tests. Run daemons are
+// running until a test changes their state.
+type FakeDaemonRuntime struct {
+	mu      sync.Mutex
+	next    int
+	Daemons map[string]*FakeDaemon
+	// RunErr is returned by Run if set.
+	RunErr error
+}
+
+type FakeDaemon struct {
+	Spec  DaemonSpec
+	State DaemonState
+	Logs  string
+}
+
+var _ DaemonRuntime = &FakeDaemonRuntime{}
+
+func NewFakeDaemonRuntime() *FakeDaemonRuntime {
+	return &FakeDaemonRuntime{Daemons: map[string]*FakeDaemon{}}
+}
+
+func (f *FakeDaemonRuntime) Run(spec DaemonSpec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.RunErr != nil {
+		return "", f.RunErr
+	}
+	f.next++
+	id := fmt.Sprintf("fake%d", f.next)
+	if spec.Name != "" {
+		if f.find(spec.Name) != nil {
+			return "", fmt.Errorf("name %s is already in use", spec.Name)
+		}
+	}
+	f.Daemons[id] = &FakeDaemon{
+		Spec: spec,
+		State: DaemonState{
+			ID:        id,
+			Status:    "running",
+			StartedAt: time.Now(),
+			Labels:    spec.Labels,
+		},
+	}
+	return id, nil
+}
+
+func (f *FakeDaemonRuntime) Find(labels map[string]string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for _, id := range f.ids() {
+		d := f.Daemons[id]
+		match := true
+		for k, v := range labels {
+			if l, ok := d.State.Labels[k]; !ok || (v != "" && l != v) {
+				match = false
+				break
+			}
+		}
+		if match {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (f *FakeDaemonRuntime) Inspect(id string) (*DaemonState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.find(id)
+	if d == nil {
+		return nil, ErrDaemonNotFound
+	}
+	st := d.State
+	return &st, nil
+}
+
+func (f *FakeDaemonRuntime) Logs(id string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.find(id)
+	if d == nil {
+		return "", ErrDaemonNotFound
+	}
+	return d.Logs, nil
+}
+
+func (f *FakeDaemonRuntime) Remove(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.find(id)
+	if d == nil {
+		return ErrDaemonNotFound
+	}
+	delete(f.Daemons, d.State.ID)
+	return nil
+}
+
+// Exit marks daemon exited with code and output.
+func (f *FakeDaemonRuntime) Exit(id string, code int, logs string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d := f.find(id); d != nil {
+		d.State.Status = "exited"
+		d.State.ExitCode = code
+		d.State.FinishedAt = time.Now()
+		d.Logs += logs
+	}
+}
+
+// find looks daemon up by ID or name.
+func (f *FakeDaemonRuntime) find(id string) *FakeDaemon {
+	if d, ok := f.Daemons[id]; ok {
+		return d
+	}
+	for _, d := range f.Daemons {
+		if d.Spec.Name != "" && d.Spec.Name == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *FakeDaemonRuntime) ids() []string {
+	m := make(map[string]string, len(f.Daemons))
+	for id := range f.Daemons {
+		m[id] = id
+	}
+	return sortedKeys(m)
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"fmt"
+	"io"
+)
+
+// FakeExec is a simple scripted Interface for tests.
+type FakeExec struct {
+	CommandScript []FakeCommandAction
+	CommandCalls  int
+	LookPathFunc  func(string) (string, error)
+}
+
+type FakeCommandAction func(cmd string, args ...string) Cmd
+
+var _ Interface = &FakeExec{}
+
+func (fake *FakeExec) Command(cmd string, args ...string) Cmd {
+	if fake.CommandCalls > len(fake.CommandScript)-1 {
+		panic(fmt.Sprintf("ran out of Command() actions. Could not handle command [%d]: %s %v", fake.CommandCalls, cmd, args))
+	}
+	i := fake.CommandCalls
+	fake.CommandCalls++
+	return fake.CommandScript[i](cmd, args...)
+}
+
+func (fake *FakeExec) LookPath(file string) (string, error) {
+	if fake.LookPathFunc != nil {
+		return fake.LookPathFunc(file)
+	}
+	return file, nil
+}
+
+// FakeCmd is a simple scripted Cmd for tests.
+type FakeCmd struct {
+	Argv                 []string
+	CombinedOutputScript []FakeCombinedOutputAction
+	CombinedOutputCalls  int
+	CombinedOutputLog    [][]string
+	Dirs                 []string
+	Env                  []string
+	Stdin                io.Reader
+	Stdout               io.Writer
+}
+
+type FakeCombinedOutputAction func() ([]byte, error)
+
+var _ Cmd = &FakeCmd{}
+
+// InitFakeCmd binds cmd to a command line, to be used in FakeCommandAction.
+func InitFakeCmd(fake *FakeCmd, cmd string, args ...string) Cmd {
+	fake.Argv = append([]string{cmd}, args...)
+	return fake
+}
+
+func (fake *FakeCmd) SetDir(dir string) {
+	fake.Dirs = append(fake.Dirs, dir)
+}
+
+func (fake *FakeCmd) SetEnv(env []string) {
+	fake.Env = append(fake.Env, env...)
+}
+
+func (fake *FakeCmd) SetStdin(in io.Reader) {
+	fake.Stdin = in
+}
+
+func (fake *FakeCmd) SetStdout(out io.Writer) {
+	fake.Stdout = out
+}
+
+func (fake *FakeCmd) CombinedOutput() ([]byte, error) {
+	if fake.CombinedOutputCalls > len(fake.CombinedOutputScript)-1 {
+		panic("ran out of CombinedOutput() actions")
+	}
+	if fake.CombinedOutputLog == nil {
+		fake.CombinedOutputLog = [][]string{}
+	}
+	i := fake.CombinedOutputCalls
+	fake.CombinedOutputLog = append(fake.CombinedOutputLog, append([]string{}, fake.Argv...))
+	fake.CombinedOutputCalls++
+	return fake.CombinedOutputScript[i]()
+}
+
+func (fake *FakeCmd) Output() ([]byte, error) {
+	return fake.CombinedOutput()
+}
+
+func (fake *FakeCmd) Stop() {
+}
+
+// FakeExitError is a simple fake ExitError type.
+type FakeExitError struct {
+	Status int
+}
+
+var _ ExitError = FakeExitError{}
+
+func (fake FakeExitError) String() string {
+	return fmt.Sprintf("exit %d", fake.Status)
+}
+
+func (fake FakeExitError) Error() string {
+	return fake.String()
+}
+
+func (fake FakeExitError) Exited() bool {
+	return true
+}
+
+func (fake FakeExitError) ExitStatus() int {
+	return fake.Status
+}
+
+// FakeCommandLog records command lines run through FakeExec.
+type FakeCommandLog struct {
+	Cmds [][]string
+}
+
+// Action records the command, its CombinedOutput returns out and err.
+func (l *FakeCommandLog) Action(out string, err error) FakeCommandAction {
+	return func(cmd string, args ...string) Cmd {
+		l.Cmds = append(l.Cmds, append([]string{cmd}, args...))
+		fake := &FakeCmd{CombinedOutputScript: []FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(out), err },
+		}}
+		return InitFakeCmd(fake, cmd, args...)
+	}
+}
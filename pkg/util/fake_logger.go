@@ -0,0 +1,28 @@
+package util
+
+// TestLog is the part of testing.TB FakeLogger writes to.
+type TestLog interface {
+	Log(args ...interface{})
+}
+
+// FakeLogger writes messages to the test log, redacted as in syslog.
+type FakeLogger struct {
+	T TestLog
+}
+
+var _ Logger = FakeLogger{}
+
+func (l FakeLogger) Info(m string) error {
+	l.T.Log(Redact(m))
+	return nil
+}
+
+func (l FakeLogger) Warning(m string) error {
+	l.T.Log(Redact(m))
+	return nil
+}
+
+func (l FakeLogger) Err(m string) error {
+	l.T.Log(Redact(m))
+	return nil
+}
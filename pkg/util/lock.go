@@ -0,0 +1,86 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrLockBusy = errors.New("lock is held by another process")
+
+const lockPollInterval = 100 * time.Millisecond
+
+// FileLock is an exclusive lock of node state shared by driver processes.
+// It is flock(2) based, so the kernel releases it when the owner dies.
+// Lock file is opened close-on-exec and isn't inherited by child processes.
+// Owner pid is written to the file only to report who holds the lock,
+// pids are not comparable across pid namespaces of driver processes.
+type FileLock struct {
+	f *os.File
+}
+
+// TryLock takes lock at path without waiting, ErrLockBusy is returned
+// if it is held by another process.
+func TryLock(path string) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, ErrLockBusy
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed lock '%s': %v", path, err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &FileLock{f: f}, nil
+}
+
+// Lock waits for lock at path until it is taken, timeout passes
+// or ctx is done. Zero timeout waits as long as ctx allows.
+func Lock(ctx context.Context, path string, timeout time.Duration) (*FileLock, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		l, err := TryLock(path)
+		if err != ErrLockBusy {
+			return l, err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			owner := "unknown process"
+			if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 {
+				owner = "pid " + strings.TrimSpace(string(data))
+			}
+			return nil, fmt.Errorf("Failed lock '%s' held by %s: %v", path, owner, ctx.Err())
+		}
+	}
+}
+
+// Unlock releases the lock. Lock file is left in place, removing it
+// would let waiters lock different files.
+func (l *FileLock) Unlock() error {
+	defer l.f.Close()
+	l.f.Truncate(0)
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flock locks belong to open files, so a second open in the same
+// process contends like another driver process would.
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "mount.lock")
+	first, err := TryLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(path); err != ErrLockBusy {
+		t.Fatalf("second lock while held: got %v, want %v", err, ErrLockBusy)
+	}
+	_, err = Lock(context.Background(), path, 3*lockPollInterval)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("held by pid %d", os.Getpid())) {
+		t.Errorf("waiting lock: got %v, want timeout naming the owner", err)
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := TryLock(path)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	second.Unlock()
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mount.lock")
+	first, err := TryLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(2*lockPollInterval, func() {
+		first.Unlock()
+	})
+	second, err := Lock(context.Background(), path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Unlock()
+}
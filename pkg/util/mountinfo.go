@@ -0,0 +1,262 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MountInfoFile lists mounts of our mount namespace, see proc(5).
+var MountInfoFile = "/proc/self/mountinfo"
+
+// MountInfo is a line of mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+type MountInfo struct {
+	ID       int
+	ParentID int
+	Major    int
+	Minor    int
+	// Root is the directory of the source FS mounted, it isn't / for bind mounts.
+	Root       string
+	MountPoint string
+	// Options are per mount options, e.g. ro or nosuid.
+	Options []string
+	// Optional are propagation fields, e.g. shared:1 or master:2.
+	Optional []string
+	FSType   string
+	Source   string
+	// SuperOptions are options of the FS.
+	SuperOptions []string
+}
+
+// ReadOnly tells whether the mount or its FS is read-only.
+func (m *MountInfo) ReadOnly() bool {
+	return hasOption(m.Options, "ro") || hasOption(m.SuperOptions, "ro")
+}
+
+// HasOption checks per mount and FS options.
+func (m *MountInfo) HasOption(option string) bool {
+	return hasOption(m.Options, option) || hasOption(m.SuperOptions, option)
+}
+
+// Propagation returns shared, slave, "shared,slave", unbindable or private.
+func (m *MountInfo) Propagation() string {
+	var p []string
+	for _, o := range m.Optional {
+		switch {
+		case strings.HasPrefix(o, "shared:"):
+			p = append(p, "shared")
+		case strings.HasPrefix(o, "master:"):
+			p = append(p, "slave")
+		case o == "unbindable":
+			p = append(p, "unbindable")
+		}
+	}
+	if len(p) == 0 {
+		return "private"
+	}
+	return strings.Join(p, ",")
+}
+
+// IsFUSE tells whether the mount is served by a FUSE daemon.
+func (m *MountInfo) IsFUSE() bool {
+	return m.FSType == "fuse" || strings.HasPrefix(m.FSType, "fuse.")
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMountInfo parses mountinfo format.
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		m, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func parseMountInfoLine(line string) (MountInfo, error) {
+	var m MountInfo
+	f := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(f); i++ {
+		if f[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(f) < sep+3 {
+		return m, fmt.Errorf("Bad mountinfo line '%s'", line)
+	}
+	var err error
+	if m.ID, err = strconv.Atoi(f[0]); err != nil {
+		return m, fmt.Errorf("Bad mount ID in mountinfo line '%s'", line)
+	}
+	if m.ParentID, err = strconv.Atoi(f[1]); err != nil {
+		return m, fmt.Errorf("Bad parent ID in mountinfo line '%s'", line)
+	}
+	dev := strings.SplitN(f[2], ":", 2)
+	if len(dev) != 2 {
+		return m, fmt.Errorf("Bad device in mountinfo line '%s'", line)
+	}
+	if m.Major, err = strconv.Atoi(dev[0]); err != nil {
+		return m, fmt.Errorf("Bad device in mountinfo line '%s'", line)
+	}
+	if m.Minor, err = strconv.Atoi(dev[1]); err != nil {
+		return m, fmt.Errorf("Bad device in mountinfo line '%s'", line)
+	}
+	m.Root = unescapeMountInfo(f[3])
+	m.MountPoint = unescapeMountInfo(f[4])
+	m.Options = strings.Split(f[5], ",")
+	m.Optional = f[6:sep]
+	m.FSType = unescapeMountInfo(f[sep+1])
+	m.Source = unescapeMountInfo(f[sep+2])
+	if len(f) > sep+3 {
+		m.SuperOptions = strings.Split(f[sep+3], ",")
+	}
+	return m, nil
+}
+
+// unescapeMountInfo decodes octal escapes kernel writes for space,
+// tab, newline and backslash.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// GetMounts returns all mounts of our mount namespace.
+func GetMounts() ([]MountInfo, error) {
+	f, err := os.Open(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
+
+// FindMount returns the topmost mount at path, nil if path isn't a mount point.
+// The path itself isn't accessed, so it works for dead FUSE mounts too.
+func FindMount(path string) (*MountInfo, error) {
+	path, err := mountPointPath(path)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	// Mounts over other ones follow them.
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == path {
+			return &mounts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// mountPointPath returns absolute path with symlinks of its parent
+// resolved, as kernel shows it.
+func mountPointPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if path == "/" {
+		return path, nil
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(path)), nil
+}
+
+// staleMountTimeout bounds statfs of FUSE mount. Daemon which is alive
+// but doesn't answer, e.g. stopped or deadlocked, blocks it forever.
+// It is a variable so tests don't wait for it.
+var staleMountTimeout = 10 * time.Second
+
+// statfs is a variable so tests can play dead and hung FUSE daemons.
+var statfs = syscall.Statfs
+
+// IsStaleMount tells whether path is a FUSE mount whose daemon is gone,
+// access to it fails with "transport endpoint is not connected", or
+// whose daemon doesn't answer within staleMountTimeout.
+func IsStaleMount(path string) (bool, error) {
+	m, err := FindMount(path)
+	if err != nil || m == nil || !m.IsFUSE() {
+		return false, err
+	}
+	// Attributes of mount root may be cached, statfs always asks the daemon.
+	// Hung statfs can't be interrupted, its goroutine is left behind
+	// until the daemon answers or FUSE connection is aborted.
+	done := make(chan error, 1)
+	stat := statfs
+	go func() {
+		var st syscall.Statfs_t
+		done <- stat(path, &st)
+	}()
+	select {
+	case err = <-done:
+		return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ECONNABORTED), nil
+	case <-time.After(staleMountTimeout):
+		return true, nil
+	}
+}
+
+// DetachStaleMount lazily detaches path if it is a stale FUSE mount,
+// processes still holding it don't block the detach.
+func DetachStaleMount(slog Logger, path string) (bool, error) {
+	stale, err := IsStaleMount(path)
+	if err != nil || !stale {
+		return false, err
+	}
+	slog.Warning(fmt.Sprintf("FUSE mount '%s' is stale, detaching", path))
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return false, fmt.Errorf("Failed detach stale mount '%s': %v", path, err)
+	}
+	return true, nil
+}
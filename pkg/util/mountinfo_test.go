@@ -0,0 +1,243 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testMountInfo is mountinfo of a node with a FUSE volume whose name has
+// a space, a tmpfs nested in it, a dataset bound into two pods and a mount
+// over one of the binds.
+const testMountInfo = `22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw,discard
+23 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+29 22 0:26 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+612 22 0:52 / /var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my\040data rw,nosuid,nodev,relatime shared:301 master:12 - fuse.s3fs s3fs rw,user_id=0,group_id=0,allow_other
+640 612 0:55 / /var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my\040data/nested rw,relatime shared:320 - tmpfs tmpfs rw,size=1024k
+701 22 259:1 /pluk-tmp/ws/ds/1.0.0 /var/lib/kubelet/pods/77aa/volumes/kuberlab~download/data ro,relatime shared:1 - ext4 /dev/nvme0n1p1 rw,discard
+702 22 259:1 /pluk-tmp/ws/ds/1.0.0 /var/lib/kubelet/pods/88bb/volumes/kuberlab~download/data ro,relatime shared:1 - ext4 /dev/nvme0n1p1 rw,discard
+710 22 0:60 / /mnt/tab\011and\134slash rw,relatime - tmpfs tmp\040fs rw
+720 702 0:61 / /var/lib/kubelet/pods/88bb/volumes/kuberlab~download/data rw,relatime unbindable - tmpfs tmpfs rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 9 {
+		t.Fatalf("got %d mounts, want 9", len(mounts))
+	}
+	cases := []struct {
+		i           int
+		want        MountInfo
+		readOnly    bool
+		propagation string
+		fuse        bool
+	}{
+		{0, MountInfo{ID: 22, ParentID: 1, Major: 259, Minor: 1, Root: "/", MountPoint: "/",
+			Options: []string{"rw", "relatime"}, Optional: []string{"shared:1"},
+			FSType: "ext4", Source: "/dev/nvme0n1p1", SuperOptions: []string{"rw", "discard"}}, false, "shared", false},
+		// No optional fields before the separator.
+		{1, MountInfo{ID: 23, ParentID: 22, Major: 0, Minor: 22, Root: "/", MountPoint: "/proc",
+			Options: []string{"rw", "nosuid", "nodev", "noexec", "relatime"}, Optional: []string{},
+			FSType: "proc", Source: "proc", SuperOptions: []string{"rw"}}, false, "private", false},
+		{2, MountInfo{ID: 29, ParentID: 22, Major: 0, Minor: 26, Root: "/", MountPoint: "/sys/fs/cgroup",
+			Options: []string{"ro", "nosuid", "nodev", "noexec"}, Optional: []string{"shared:9"},
+			FSType: "tmpfs", Source: "tmpfs", SuperOptions: []string{"ro", "mode=755"}}, true, "shared", false},
+		// Several optional fields, escaped space in mount point.
+		{3, MountInfo{ID: 612, ParentID: 22, Major: 0, Minor: 52, Root: "/", MountPoint: "/var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my data",
+			Options: []string{"rw", "nosuid", "nodev", "relatime"}, Optional: []string{"shared:301", "master:12"},
+			FSType: "fuse.s3fs", Source: "s3fs", SuperOptions: []string{"rw", "user_id=0", "group_id=0", "allow_other"}}, false, "shared,slave", true},
+		// Bind of a directory, root isn't /.
+		{5, MountInfo{ID: 701, ParentID: 22, Major: 259, Minor: 1, Root: "/pluk-tmp/ws/ds/1.0.0", MountPoint: "/var/lib/kubelet/pods/77aa/volumes/kuberlab~download/data",
+			Options: []string{"ro", "relatime"}, Optional: []string{"shared:1"},
+			FSType: "ext4", Source: "/dev/nvme0n1p1", SuperOptions: []string{"rw", "discard"}}, true, "shared", false},
+		{7, MountInfo{ID: 710, ParentID: 22, Major: 0, Minor: 60, Root: "/", MountPoint: "/mnt/tab\tand\\slash",
+			Options: []string{"rw", "relatime"}, Optional: []string{},
+			FSType: "tmpfs", Source: "tmp fs", SuperOptions: []string{"rw"}}, false, "private", false},
+		{8, MountInfo{ID: 720, ParentID: 702, Major: 0, Minor: 61, Root: "/", MountPoint: "/var/lib/kubelet/pods/88bb/volumes/kuberlab~download/data",
+			Options: []string{"rw", "relatime"}, Optional: []string{"unbindable"},
+			FSType: "tmpfs", Source: "tmpfs", SuperOptions: []string{"rw"}}, false, "unbindable", false},
+	}
+	for _, c := range cases {
+		m := mounts[c.i]
+		if !reflect.DeepEqual(m, c.want) {
+			t.Errorf("line %d: got %+v\nwant %+v", c.i+1, m, c.want)
+		}
+		if m.ReadOnly() != c.readOnly || m.Propagation() != c.propagation || m.IsFUSE() != c.fuse {
+			t.Errorf("line %d: got read-only %v propagation %s FUSE %v", c.i+1, m.ReadOnly(), m.Propagation(), m.IsFUSE())
+		}
+	}
+}
+
+func TestParseMountInfoErrors(t *testing.T) {
+	for _, line := range []string{
+		"22 1 259:1 / / rw,relatime shared:1 ext4 /dev/root rw",
+		"22 1 259:1 / / rw - ext4",
+		"x 1 259:1 / / rw - ext4 /dev/root rw",
+		"22 1 259 / / rw - ext4 /dev/root rw",
+	} {
+		if _, err := ParseMountInfo(strings.NewReader(line + "\n")); err == nil {
+			t.Errorf("'%s' is parsed", line)
+		}
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040data`, "/mnt/my data"},
+		{`/mnt/a\011b\012c`, "/mnt/a\tb\nc"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`\040\040`, "  "},
+		// Not escapes of the kernel are kept as they are.
+		{`/mnt/a\04`, `/mnt/a\04`},
+		{`/mnt/a\999`, `/mnt/a\999`},
+		{`/mnt/a\400`, `/mnt/a\400`},
+		{`/mnt/a\`, `/mnt/a\`},
+	}
+	for _, c := range cases {
+		if got := unescapeMountInfo(c.in); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func setMountInfo(t *testing.T, data string) {
+	file := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := MountInfoFile
+	MountInfoFile = file
+	t.Cleanup(func() {
+		MountInfoFile = old
+	})
+}
+
+func TestFindMount(t *testing.T) {
+	setMountInfo(t, testMountInfo)
+	cases := []struct {
+		path string
+		// id is 0 if path isn't a mount point.
+		id int
+	}{
+		{"/", 22},
+		{"/proc", 23},
+		{"/var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my data", 612},
+		{"/var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my data/", 612},
+		{"/var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my data/nested", 640},
+		{"/var/lib/kubelet/pods/9f1c/volumes/kuberlab~s3/my data/other", 0},
+		// Binds of the same source are told apart by mount point.
+		{"/var/lib/kubelet/pods/77aa/volumes/kuberlab~download/data", 701},
+		// The topmost of mounts at the same path.
+		{"/var/lib/kubelet/pods/88bb/volumes/kuberlab~download/data", 720},
+		{"/var/lib/kubelet/pods/88bb/volumes/kuberlab~download", 0},
+		{"/mnt/tab\tand\\slash", 710},
+		{`/mnt/tab\011and\134slash`, 0},
+		{"/pluk-tmp/ws/ds/1.0.0", 0},
+	}
+	for _, c := range cases {
+		m, err := FindMount(c.path)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		switch {
+		case c.id == 0 && m != nil:
+			t.Errorf("%s: got mount %d, want none", c.path, m.ID)
+		case c.id != 0 && m == nil:
+			t.Errorf("%s: got no mount, want %d", c.path, c.id)
+		case c.id != 0 && m.ID != c.id:
+			t.Errorf("%s: got mount %d, want %d", c.path, m.ID, c.id)
+		}
+	}
+}
+
+func setStatfs(t *testing.T, f func(path string, st *syscall.Statfs_t) error) {
+	old, oldTimeout := statfs, staleMountTimeout
+	statfs, staleMountTimeout = f, 50*time.Millisecond
+	t.Cleanup(func() {
+		statfs, staleMountTimeout = old, oldTimeout
+	})
+}
+
+func TestIsStaleMount(t *testing.T) {
+	dir := t.TempDir()
+	fuse := filepath.Join(dir, "fuse")
+	other := filepath.Join(dir, "tmpfs")
+	setMountInfo(t, testMountInfo+fmt.Sprintf(
+		"800 22 0:70 / %s rw,nosuid,nodev,relatime shared:400 - fuse.s3fs s3fs rw,user_id=0,group_id=0\n"+
+			"801 22 0:71 / %s rw,relatime - tmpfs tmpfs rw\n", fuse, other))
+	hung := make(chan struct{})
+	defer close(hung)
+	cases := []struct {
+		name   string
+		path   string
+		statfs func(path string, st *syscall.Statfs_t) error
+		stale  bool
+	}{
+		{"healthy", fuse, func(string, *syscall.Statfs_t) error { return nil }, false},
+		{"daemon gone", fuse, func(string, *syscall.Statfs_t) error { return syscall.ENOTCONN }, true},
+		{"connection aborted", fuse, func(string, *syscall.Statfs_t) error { return syscall.ECONNABORTED }, true},
+		{"other error", fuse, func(string, *syscall.Statfs_t) error { return syscall.EACCES }, false},
+		{"daemon hung", fuse, func(string, *syscall.Statfs_t) error { <-hung; return nil }, true},
+		// Only FUSE mounts are asked.
+		{"not FUSE", other, func(string, *syscall.Statfs_t) error { return syscall.ENOTCONN }, false},
+		{"not mounted", filepath.Join(dir, "none"), func(string, *syscall.Statfs_t) error { return syscall.ENOTCONN }, false},
+	}
+	for _, c := range cases {
+		var asked string
+		setStatfs(t, func(path string, st *syscall.Statfs_t) error {
+			asked = path
+			return c.statfs(path, st)
+		})
+		start := time.Now()
+		stale, err := IsStaleMount(c.path)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if stale != c.stale {
+			t.Errorf("%s: got stale %v, want %v", c.name, stale, c.stale)
+		}
+		if c.name == "daemon hung" && time.Since(start) > time.Second {
+			t.Errorf("%s: took %v", c.name, time.Since(start))
+		}
+		if c.name != "daemon hung" && (asked != "") != (c.path == fuse) {
+			t.Errorf("%s: statfs asked '%s'", c.name, asked)
+		}
+	}
+}
+
+func TestDetachStaleMount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fuse")
+	setMountInfo(t, fmt.Sprintf("800 22 0:70 / %s rw,relatime - fuse.s3fs s3fs rw\n", path))
+
+	setStatfs(t, func(string, *syscall.Statfs_t) error { return nil })
+	if detached, err := DetachStaleMount(FakeLogger{T: t}, path); detached || err != nil {
+		t.Errorf("healthy mount: got detached %v, %v", detached, err)
+	}
+
+	// Path isn't really mounted, so the detach fails after the mount is found stale.
+	hung := make(chan struct{})
+	defer close(hung)
+	for _, f := range []func(string, *syscall.Statfs_t) error{
+		func(string, *syscall.Statfs_t) error { return syscall.ENOTCONN },
+		func(string, *syscall.Statfs_t) error { <-hung; return nil },
+	} {
+		setStatfs(t, f)
+		detached, err := DetachStaleMount(FakeLogger{T: t}, path)
+		if detached || err == nil || !strings.Contains(err.Error(), "Failed detach stale mount") {
+			t.Errorf("stale mount: got detached %v, %v", detached, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"encoding/base64"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+const redacted = "******"
+
+var (
+	secretsMu sync.RWMutex
+	// secrets counts registrations of each value, so concurrent requests
+	// sharing a secret don't unregister it for each other.
+	secrets = make(map[string]int)
+)
+
+// AddSecret registers value which must never appear in logs or results.
+// Returned func unregisters it, long running driver calls it once
+// the request using the value is served.
+func AddSecret(value string) func() {
+	if value == "" {
+		return func() {}
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets[value]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			secretsMu.Lock()
+			defer secretsMu.Unlock()
+			if secrets[value]--; secrets[value] <= 0 {
+				delete(secrets, value)
+			}
+		})
+	}
+}
+
+// AddSecrets registers values and their trimmed forms the way
+// GetSecretString returns them. Returned func unregisters all of them.
+func AddSecrets(values ...string) func() {
+	var release []func()
+	for _, v := range values {
+		release = append(release, AddSecret(v))
+		if t := trimSecret(v); t != v {
+			release = append(release, AddSecret(t))
+		}
+	}
+	return func() {
+		for _, r := range release {
+			r()
+		}
+	}
+}
+
+// AddConfSecrets registers all kubernetes.io/secret/* values of share options.
+func AddConfSecrets(conf map[string]interface{}) func() {
+	var values []string
+	for k, v := range conf {
+		s, ok := v.(string)
+		if !ok || !strings.HasPrefix(k, "kubernetes.io/secret/") {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			values = append(values, string(b))
+		}
+	}
+	return AddSecrets(values...)
+}
+
+// Redact replaces all registered secret values in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for v := range secrets {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
+
+// Logger is the part of syslog.Writer used by the driver.
+type Logger interface {
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// redactingLogger removes registered secrets from messages before writing them to syslog.
+type redactingLogger struct {
+	w *syslog.Writer
+}
+
+func NewLogger(w *syslog.Writer) Logger {
+	return &redactingLogger{w: w}
+}
+
+func (l *redactingLogger) Info(m string) error {
+	return l.w.Info(Redact(m))
+}
+
+func (l *redactingLogger) Warning(m string) error {
+	return l.w.Warning(Redact(m))
+}
+
+func (l *redactingLogger) Err(m string) error {
+	return l.w.Err(Redact(m))
+}
@@ -4,11 +4,10 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
-	"path/filepath"
 	"strings"
-	"syscall"
 )
 
 const (
@@ -17,21 +16,14 @@ const (
 	NotSupported = "Not supported"
 )
 
+// IsMounted tells whether path is a mount point, bind mounts
+// from the same FS and dead FUSE mounts included.
 func IsMounted(mountpoint string) (bool, error) {
-	mntpoint, err := os.Stat(mountpoint)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
-	}
-	parent, err := os.Stat(filepath.Join(mountpoint, ".."))
+	m, err := FindMount(mountpoint)
 	if err != nil {
 		return false, err
 	}
-	mntpointSt := mntpoint.Sys().(*syscall.Stat_t)
-	parentSt := parent.Sys().(*syscall.Stat_t)
-	return mntpointSt.Dev != parentSt.Dev, nil
+	return m != nil, nil
 }
 
 func ExecCommand(exec Interface, command string, args []string, dir string) ([]byte, error) {
@@ -42,88 +34,6 @@ func ExecCommand(exec Interface, command string, args []string, dir string) ([]b
 	return cmd.CombinedOutput()
 }
 
-func TryStopMountDaemon(path string) error {
-	exec := NewExec()
-	cid, err := MountDaemon(path, exec)
-	if err != nil {
-		return err
-	}
-	return StopDaemon(cid, exec)
-}
-
-func MountDaemon(path string, exec Interface) (string, error) {
-	out, err := ExecCommand(exec, "docker", []string{"ps", "-a",
-		"--filter",
-		"label=flex.mount.path=" + path,
-		"--format",
-		`{{ .ID }}`,
-	}, "")
-	if err != nil {
-		return "", fmt.Errorf("Failed list docker containers: %v, %v", string(out), err)
-	}
-	if len(out) > 0 {
-		return strings.Trim(string(out), "\n"), nil
-	} else {
-		return "", nil
-	}
-}
-
-func CheckDaemon(id string, exec Interface) error {
-	// docker inspect c4e1f5a1af33 --format '{{ .State.Status }} {{ .State.ExitCode}}'
-	args := []string{"inspect", id, "--format", "{{ .State.Status }}"}
-	out, err := ExecCommand(exec, "docker", args, "")
-	if err != nil {
-		return err
-	}
-	outS := strings.Trim(string(out), "\n")
-
-	if outS == "exited" {
-		return errors.New("Daemon is exited")
-	} else {
-		return nil
-	}
-}
-
-func DaemonLogs(id string, exec Interface) (string, error) {
-	// docker inspect c4e1f5a1af33 --format '{{ .State.Status }} {{ .State.ExitCode}}'
-	args := []string{"logs", id}
-	out, err := ExecCommand(exec, "docker", args, "")
-	if err != nil {
-		return "", err
-	}
-	return string(out), nil
-}
-
-func StopDaemon(id string, exec Interface) error {
-	out, err := ExecCommand(exec, "docker", []string{"rm", "--force", id}, "")
-	if err != nil {
-		return fmt.Errorf("Failed remove docker container: %v, %v %v", id, out, err)
-	}
-	return nil
-}
-
-func ParseFindMntOut(out string) (string, string, error) {
-	//root/test1 /dev/mapper/ASRock--vg-home[/tmp/test2] ext4   rw,relatime,errors=remount-ro,data=ordered
-	p1 := strings.Split(out, "/n")
-	if len(p1) < 1 {
-		return "", "", fmt.Errorf("Mount not found in '%v'", out)
-	} else {
-		p1 := strings.Split(p1[0], " ")
-		if len(p1) < 2 {
-			return "", "", fmt.Errorf("Mount not found in '%v'", out)
-		}
-		i1 := strings.Index(p1[1], "[")
-		if i1 < 0 {
-			return "", "", fmt.Errorf("Mount not found in '%v'", out)
-		}
-		i2 := strings.Index(p1[1], "]")
-		if i2 < 0 {
-			return "", "", fmt.Errorf("Mount not found in '%v'", out)
-		}
-		return p1[0], (p1[0])[i1:i2], nil
-	}
-}
-
 func GetSecretString(conf map[string]interface{}, name string) (string, error) {
 	if v, ok := conf["kubernetes.io/secret/"+name]; !ok {
 		return "", fmt.Errorf("Secret '%s' not found", name)
@@ -133,7 +43,7 @@ func GetSecretString(conf map[string]interface{}, name string) (string, error) {
 			if err != nil {
 				return "", fmt.Errorf("Failed decode secret '%s'", name)
 			}
-			return strings.Trim(strings.Trim(string(sb), "\n"), "\r"), nil
+			return trimSecret(string(sb)), nil
 		} else {
 			return "", fmt.Errorf("Bad secret '%s' value", name)
 		}
@@ -141,6 +51,10 @@ func GetSecretString(conf map[string]interface{}, name string) (string, error) {
 
 }
 
+func trimSecret(s string) string {
+	return strings.Trim(strings.Trim(s, "\n"), "\r")
+}
+
 func LocalIP() (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -177,3 +91,22 @@ func LocalIP() (string, error) {
 	}
 	return "", errors.New("are you connected to the network?")
 }
+
+// WriteSecretFile writes data to a new root-only file and returns its path.
+// Caller removes the file when it is no longer needed.
+func WriteSecretFile(prefix string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
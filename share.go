@@ -6,21 +6,26 @@ import (
 	"log/syslog"
 	"os"
 	"strings"
-	"syscall"
 
+	"github.com/kuberlab/s3share/pkg/csi"
 	"github.com/kuberlab/s3share/pkg/share"
+	_ "github.com/kuberlab/s3share/pkg/share/backends"
 	"github.com/kuberlab/s3share/pkg/util"
 )
 
-var slog *syslog.Writer
+var (
+	slog util.Logger
+	// node is driver config of the node, loaded once per call.
+	node share.NodeConfig
+)
 
 func main() {
 	args := os.Args
-	var err error
-	slog, err = syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, "kuberlab-share")
+	w, err := syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, "kuberlab-share")
 	if err != nil {
 		panic(err)
 	}
+	slog = util.NewLogger(w)
 	if len(args) < 2 {
 		log("unknown", ResultStatus{
 			Status:  util.Failure,
@@ -29,30 +34,67 @@ func main() {
 		os.Exit(-1)
 	}
 
-	switch args[1] {
-	case "mount":
-		if len(args) < 4 {
-			log("mount", ResultStatus{
+	node, err = share.LoadNodeConfig(share.FindNodeConfig())
+	if err != nil {
+		switch args[1] {
+		case "init", "mount", "mountdevice", "csi":
+			log(args[1], ResultStatus{
 				Status:  util.Failure,
-				Message: fmt.Sprintf("Wrong args number: %d", len(args)-1),
+				Message: err.Error(),
 			})
-			os.Exit(-1)
+			os.Exit(1)
 		}
-		mount(args[2], args[3])
+		// Volumes must still be unmountable with broken config.
+		slog.Warning(err.Error())
+	}
+
+	switch args[1] {
 	case "init":
 		log("init", ResultStatus{
 			Status:       util.Success,
-			Capabilities: map[string]interface{}{"attach": false},
+			Capabilities: map[string]interface{}{"attach": true, "selinuxRelabel": false},
+			FSTypes:      share.Backends(),
 		})
+	case "getvolumename":
+		checkArgs(args, 3)
+		getVolumeName(args[2])
+	case "attach":
+		checkArgs(args, 4)
+		attach(args[2], args[3])
+	case "waitforattach":
+		checkArgs(args, 4)
+		waitForAttach(args[2], args[3])
+	case "isattached":
+		checkArgs(args, 4)
+		isAttached(args[2], args[3])
+	case "detach":
+		checkArgs(args, 4)
+		detach(args[2], args[3])
+	case "mountdevice":
+		checkArgs(args, 5)
+		mountDevice(args[2], args[3], args[4])
+	case "unmountdevice":
+		checkArgs(args, 3)
+		unmountDevice(args[2])
+	case "mount":
+		checkArgs(args, 4)
+		mount(args[2], args[3])
 	case "unmount":
-		if len(args) < 3 {
-			log("unmount", ResultStatus{
-				Status:  util.Failure,
-				Message: fmt.Sprintf("Wrong args number: %d", len(args)-1),
-			})
-			os.Exit(-1)
-		}
+		checkArgs(args, 3)
 		unmount(args[2])
+	case "csi":
+		checkArgs(args, 4)
+		runCSI(args[2], args[3])
+	case "gc":
+		// gc [--dry-run], run by cron or by hand on the node.
+		gc(len(args) > 2 && args[2] == "--dry-run")
+	case "helper":
+		// Started by share.StartHelper, output is not read by anyone.
+		checkArgs(args, 4)
+		if err := share.RunHelper(slog, args[2], os.Stdin, args[3]); err != nil {
+			slog.Err(fmt.Sprintf("Helper '%s' for '%s' failed: %v", args[2], args[3], err))
+			os.Exit(1)
+		}
 	default:
 		log(args[1], ResultStatus{
 			Status: util.NotSupported,
@@ -61,16 +103,134 @@ func main() {
 
 }
 
+func checkArgs(args []string, n int) {
+	if len(args) < n {
+		log(args[1], ResultStatus{
+			Status:  util.Failure,
+			Message: fmt.Sprintf("Wrong args number: %d", len(args)-1),
+		})
+		os.Exit(-1)
+	}
+}
+
 type ResultStatus struct {
 	Status       string                 `json:"status"`
 	Message      string                 `json:"message"`
 	Capabilities map[string]interface{} `json:"capabilities"`
+	VolumeName   string                 `json:"volumeName,omitempty"`
+	Device       string                 `json:"device,omitempty"`
+	Attached     bool                   `json:"attached,omitempty"`
+	FSTypes      []string               `json:"fsTypes,omitempty"`
+	GC           *share.GCResult        `json:"gc,omitempty"`
+}
+
+func getVolumeName(conf string) {
+	name := volumeName("getvolumename", conf)
+	log("getvolumename", ResultStatus{
+		Status:     util.Success,
+		VolumeName: name,
+	})
+}
+
+// Shares are network filesystems, so there is nothing to attach to the node.
+// The volume name is used as a virtual device name to tie mountdevice and
+// mount calls of the same volume together.
+func attach(conf string, node string) {
+	slog.Info(fmt.Sprintf("Attach request to node '%s'", node))
+	name := volumeName("attach", conf)
+	log("attach", ResultStatus{
+		Status: util.Success,
+		Device: name,
+	})
+}
+
+func waitForAttach(device string, conf string) {
+	if _, err := getConf(conf); err != nil {
+		log("waitforattach", ResultStatus{
+			Status:  util.Failure,
+			Message: err.Error(),
+		})
+		os.Exit(1)
+	}
+	log("waitforattach", ResultStatus{
+		Status: util.Success,
+		Device: device,
+	})
+}
+
+func isAttached(conf string, node string) {
+	volumeName("isattached", conf)
+	log("isattached", ResultStatus{
+		Status:   util.Success,
+		Attached: true,
+	})
+}
+
+func detach(device string, node string) {
+	slog.Info(fmt.Sprintf("Detach request '%s' from node '%s'", device, node))
+	log("detach", ResultStatus{
+		Status: util.Success,
+	})
+}
+
+func mountDevice(path string, device string, conf string) {
+	slog.Info(fmt.Sprintf("Mount device request '%s' to '%s'", device, path))
+	s, c := getShare("mountdevice", conf)
+	if err := share.MountShare(slog, util.NewExec(), node, s, c, path); err != nil {
+		log("mountdevice", ResultStatus{
+			Status:  util.Failure,
+			Message: err.Error(),
+		})
+		os.Exit(1)
+	}
+	if err := share.SaveDevice(device, path); err != nil {
+		slog.Warning(fmt.Sprintf("Failed save device '%s' state: %v", device, err))
+	}
+	log("mountdevice", ResultStatus{
+		Status: util.Success,
+	})
+}
+
+func unmountDevice(path string) {
+	slog.Info(fmt.Sprintf("Unmount device request '%s'", path))
+	if err := share.RemoveDevice(path); err != nil {
+		slog.Warning(fmt.Sprintf("Failed remove device state for '%s': %v", path, err))
+	}
+	unmount0("unmountdevice", path)
+}
+
+func volumeName(command string, conf string) string {
+	c, err := getConf(conf)
+	if err != nil {
+		log(command, ResultStatus{
+			Status:  util.Failure,
+			Message: err.Error(),
+		})
+		os.Exit(1)
+	}
+	name, err := share.VolumeName(c)
+	if err != nil {
+		log(command, ResultStatus{
+			Status:  util.Failure,
+			Message: err.Error(),
+		})
+		os.Exit(1)
+	}
+	return name
 }
 
 func mount(path string, conf string) {
 	slog.Info(fmt.Sprintf("Mount request '%s'", path))
-	s := getShare("mount", conf)
-	err := s.Mount(path)
+	s, c := getShare("mount", conf)
+	if name, err := share.VolumeName(c); err == nil {
+		// If kubelet already mounted the volume through mountdevice
+		// just bind it to the pod directory.
+		if devicePath, ok := share.MountedDevice(name); ok {
+			mode, _ := share.RequestedAccessMode(c)
+			s = share.NewBindMount(slog, devicePath, mode)
+		}
+	}
+	err := share.MountShare(slog, util.NewExec(), node, s, c, path)
 	if err != nil {
 		log("mount", ResultStatus{
 			Status:  util.Failure,
@@ -84,30 +244,59 @@ func mount(path string, conf string) {
 }
 func unmount(path string) {
 	slog.Info(fmt.Sprintf("Unmount request '%s'", path))
-	util.TryStopMountDaemon(path)
+	unmount0("unmount", path)
+}
 
-	err := syscall.Unmount(path, 0)
+func unmount0(command string, path string) {
+	err := share.UnMount(slog, util.NewExec(), node, path)
 	// Check if already unmounted
 	mounted, _ := util.IsMounted(path)
 	if !mounted {
-		log("unmount", ResultStatus{
+		log(command, ResultStatus{
 			Status: util.Success,
 		})
 		return
 	}
 	if err != nil {
-		log("unmount", ResultStatus{
+		log(command, ResultStatus{
 			Status:  util.Failure,
 			Message: err.Error(),
 		})
 		os.Exit(1)
 	}
-	log("unmount", ResultStatus{
+	log(command, ResultStatus{
 		Status: util.Success,
 	})
 }
 
-func getShare(command string, conf string) share.Share {
+func gc(dryRun bool) {
+	res := share.GC(slog, util.NewExec(), node, dryRun)
+	status := util.Success
+	if len(res.Errors) > 0 {
+		status = util.Failure
+	}
+	log("gc", ResultStatus{
+		Status:  status,
+		Message: strings.Join(res.Errors, "; "),
+		GC:      res,
+	})
+	if status != util.Success {
+		os.Exit(1)
+	}
+}
+
+func runCSI(endpoint string, nodeID string) {
+	d := csi.NewDriver(slog, util.NewExec(), node, nodeID)
+	if err := d.Run(endpoint); err != nil {
+		log("csi", ResultStatus{
+			Status:  util.Failure,
+			Message: err.Error(),
+		})
+		os.Exit(1)
+	}
+}
+
+func getShare(command string, conf string) (share.Share, map[string]interface{}) {
 	c, err := getConf(conf)
 	if err != nil {
 		log(command, ResultStatus{
@@ -116,7 +305,7 @@ func getShare(command string, conf string) share.Share {
 		})
 		os.Exit(1)
 	}
-	s, err := share.NewShare(slog, c)
+	s, err := share.NewShare(slog, node, c)
 	if err != nil {
 		log(command, ResultStatus{
 			Status:  util.Failure,
@@ -124,11 +313,12 @@ func getShare(command string, conf string) share.Share {
 		})
 		os.Exit(1)
 	}
-	return s
+	return s, c
 
 }
 
 func log(command string, res ResultStatus) {
+	res.Message = util.Redact(res.Message)
 	slog.Info(fmt.Sprintf("Command '%s' result '%s' message: %s", command, res.Status, res.Message))
 	log0(res)
 }
@@ -144,5 +334,7 @@ func getConf(s string) (map[string]interface{}, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Decode share param failed: %v", err)
 	}
+	// Driver exits after the call, secrets stay registered until then.
+	util.AddConfSecrets(c)
 	return c, nil
 }